@@ -11,7 +11,12 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.22
 )
 
-require filippo.io/edwards25519 v1.1.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/term v0.21.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
 
 replace github.com/Karol7Krawczyk/golang-migrate/migrations/config => ./migrations/config
 
@@ -1,25 +1,118 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
 	"github.com/Karol7Krawczyk/golang-migrate/migrations/db"
 	"github.com/Karol7Krawczyk/golang-migrate/migrations/handlers"
+)
 
-	"log"
+// Version is the version of the tool, recorded in the audit table. Release
+// builds set it with -ldflags "-X main.Version=v1.2.3".
+var Version = "dev"
+
+const (
+	exitError       = 1
+	exitTimeout     = 124
+	exitInterrupted = 130
 )
 
 func main() {
 	config := config.ParseFlags()
+	config.ToolVersion = Version
+	slog.SetDefault(config.NewLogger(os.Stderr))
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// After the first signal the default handling is restored, so a
+		// second one kills the process, e.g. when cleanup hangs.
+		<-sigCtx.Done()
+		stop()
+	}()
+
+	ctx := sigCtx
+
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	if code := run(ctx, config); code != 0 {
+		stop()
+		os.Exit(code)
+	}
+}
+
+func run(ctx context.Context, config config.Config) int {
+	config.RunID = handlers.NewRunID()
+
+	if config.Targets != "" || config.TargetsQuery != "" || config.Schemas != "" {
+		return runFanOut(ctx, config)
+	}
 
-	database, err := db.GetConnection(config)
+	out := config.Out()
+	if config.Structured() {
+		// Standard output is kept for the result; messages go to standard error.
+		config.Output = os.Stderr
+	}
+
+	report, err := runCommand(ctx, config)
+	if config.Structured() {
+		if writeErr := handlers.WriteReport(out, config.Format, report); writeErr != nil {
+			slog.Error("Error writing the result", "error", writeErr)
+			if err == nil {
+				return exitError
+			}
+		}
+	}
 	if err != nil {
-		log.Fatalf("Error connecting to the database: %v", err)
+		slog.Error("Command failed", "error", err)
+		return exitCode(ctx)
+	}
+
+	return 0
+}
+
+// runCommand connects to the database and runs the command. The report
+// holds the error as well, also when the command could not be started.
+func runCommand(ctx context.Context, config config.Config) (*handlers.Report, error) {
+	database, err := db.GetConnection(ctx, config)
+	if err != nil {
+		return failedReport(config, fmt.Errorf("error connecting to the database: %v", err))
 	}
 	defer db.CloseConnection(database)
 
-	if err := db.PrepareMigrationTable(database, config); err != nil {
-		log.Fatalf("Error preparing migration table: %v", err)
+	if err := db.PrepareMigrationTable(ctx, database, config); err != nil {
+		return failedReport(config, fmt.Errorf("error preparing migration table: %v", err))
 	}
 
-	handlers.HandleCommand(database, config)
+	return handlers.RunCommand(ctx, database, config)
+}
+
+func failedReport(config config.Config, err error) (*handlers.Report, error) {
+	report := handlers.NewReport(config.Command)
+	report.Error = err.Error()
+	return report, err
+}
+
+// exitCode tells a run stopped by a signal or by -timeout apart from an
+// ordinary failure.
+func exitCode(ctx context.Context) int {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return exitTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		return exitInterrupted
+	default:
+		return exitError
+	}
 }
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,12 +36,12 @@ func setupTestDB(t *testing.T) *sql.DB {
 		DBType: os.Getenv("DB_TYPE"), // Change this to mysql or postgres as needed
 	}
 
-	database, err := db.GetConnection(testConfig)
+	database, err := db.GetConnection(context.Background(), testConfig)
 	if err != nil {
 		t.Fatalf("Error connecting to the database: %v", err)
 	}
 
-	err = db.PrepareMigrationTable(database, testConfig)
+	err = db.PrepareMigrationTable(context.Background(), database, testConfig)
 	if err != nil {
 		t.Fatalf("Error preparing migration table: %v", err)
 	}
@@ -44,15 +50,32 @@ func setupTestDB(t *testing.T) *sql.DB {
 }
 
 func teardownTestDB(db *sql.DB) {
-	query := fmt.Sprintf("DROP TABLE IF EXISTS %s", testConfig.TableName)
-	_, err := db.Exec(query)
-	if err != nil {
-		log.Printf("Error dropping test table: %v", err)
+	for _, table := range []string{testConfig.TableName, testConfig.LogTable(), testConfig.AuditTable()} {
+		query := fmt.Sprintf("DROP TABLE IF EXISTS %s", table)
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Error dropping test table: %v", err)
+		}
 	}
 
 	db.Close()
 }
 
+// writeMigration creates the migration version in dir, or adds to it, with
+// files mapping file names to their content.
+func writeMigration(t *testing.T, dir, version string, files map[string]string) {
+	t.Helper()
+	migrationDir := filepath.Join(dir, version)
+	if err := os.MkdirAll(migrationDir, 0755); err != nil {
+		t.Fatalf("Failed to create migration: %v", err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(migrationDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	// Run tests
 	code := m.Run()
@@ -84,12 +107,12 @@ func TestAddAndRemoveMigration(t *testing.T) {
 	defer teardownTestDB(db)
 
 	migration := "22220101120001"
-	err := handlers.AddMigration(db, testConfig, migration)
+	err := handlers.AddMigration(context.Background(), db, testConfig, migration)
 	if err != nil {
 		t.Fatalf("Failed to add migration: %v", err)
 	}
 
-	historyMigrations, err := handlers.LoadHistoryMigrations(db, testConfig)
+	historyMigrations, err := handlers.LoadHistoryMigrations(context.Background(), db, testConfig)
 	if err != nil {
 		t.Fatalf("Failed to load history migrations: %v", err)
 	}
@@ -106,12 +129,12 @@ func TestAddAndRemoveMigration(t *testing.T) {
 		t.Fatalf("Migration %s not found in history", migration)
 	}
 
-	err = handlers.RemoveMigration(db, testConfig, migration)
+	err = handlers.RemoveMigration(context.Background(), db, testConfig, migration)
 	if err != nil {
 		t.Fatalf("Failed to remove migration: %v", err)
 	}
 
-	historyMigrations, err = handlers.LoadHistoryMigrations(db, testConfig)
+	historyMigrations, err = handlers.LoadHistoryMigrations(context.Background(), db, testConfig)
 	if err != nil {
 		t.Fatalf("Failed to load history migrations: %v", err)
 	}
@@ -138,12 +161,12 @@ func TestRunQueriesInTransaction(t *testing.T) {
 		fmt.Sprintf("INSERT INTO %s (migration, applied_at) VALUES ('20240209110543', '%s')", testConfig.TableName, time.Now().Format("2006-01-02 15:04:05")),
 	}
 
-	err := handlers.RunQueriesInTransaction(db, queries)
+	err := handlers.RunQueriesInTransaction(context.Background(), db, testConfig, queries)
 	if err != nil {
 		t.Fatalf("Failed to run queries in transaction: %v", err)
 	}
 
-	historyMigrations, err := handlers.LoadHistoryMigrations(db, testConfig)
+	historyMigrations, err := handlers.LoadHistoryMigrations(context.Background(), db, testConfig)
 	if err != nil {
 		t.Fatalf("Failed to load history migrations: %v", err)
 	}
@@ -153,6 +176,55 @@ func TestRunQueriesInTransaction(t *testing.T) {
 	}
 }
 
+func TestRunQueriesInTransactionRollback(t *testing.T) {
+	db := setupTestDB(t)
+	defer teardownTestDB(db)
+
+	queries := []string{
+		fmt.Sprintf("INSERT INTO %s (migration, applied_at) VALUES ('20240208100231', '%s')", testConfig.TableName, time.Now().Format("2006-01-02 15:04:05")),
+		"INSERT INTO missing_table (id) VALUES (1)",
+	}
+
+	err := handlers.RunQueriesInTransaction(context.Background(), db, testConfig, queries)
+	if err == nil {
+		t.Fatalf("Expected an error from the failing query")
+	}
+
+	historyMigrations, err := handlers.LoadHistoryMigrations(context.Background(), db, testConfig)
+	if err != nil {
+		t.Fatalf("Failed to load history migrations: %v", err)
+	}
+
+	if len(historyMigrations) != 0 {
+		t.Fatalf("Expected the transaction to be rolled back, found %d migrations", len(historyMigrations))
+	}
+}
+
+func TestRunQueriesInTransactionCancelled(t *testing.T) {
+	db := setupTestDB(t)
+	defer teardownTestDB(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	queries := []string{
+		fmt.Sprintf("INSERT INTO %s (migration, applied_at) VALUES ('20240208100231', '%s')", testConfig.TableName, time.Now().Format("2006-01-02 15:04:05")),
+	}
+
+	if err := handlers.RunQueriesInTransaction(ctx, db, testConfig, queries); err == nil {
+		t.Fatalf("Expected an error for a cancelled context")
+	}
+
+	historyMigrations, err := handlers.LoadHistoryMigrations(context.Background(), db, testConfig)
+	if err != nil {
+		t.Fatalf("Failed to load history migrations: %v", err)
+	}
+
+	if len(historyMigrations) != 0 {
+		t.Fatalf("Expected nothing to be committed, found %d migrations", len(historyMigrations))
+	}
+}
+
 func TestSplitSQLQueries(t *testing.T) {
 	sqlQuery := "CREATE TABLE test1 (id INT); CREATE TABLE test2 (id INT);"
 	expected := []string{
@@ -171,3 +243,1286 @@ func TestSplitSQLQueries(t *testing.T) {
 		}
 	}
 }
+
+func TestRedactedDSN(t *testing.T) {
+	cases := map[string]string{
+		"postgres://app:secret@db:5432/tenant1":           "postgres://app:xxxxx@db:5432/tenant1",
+		"host=db user=app password=secret dbname=tenant1": "host=db user=app password=xxxxx dbname=tenant1",
+		"app:secret@tcp(db:3306)/tenant1":                 "app:xxxxx@tcp(db:3306)/tenant1",
+		"app:p@ssw0rd@tcp(db:3306)/app":                   "app:xxxxx@tcp(db:3306)/app",
+		`host=db password='it\'s secret' dbname=app`:      "host=db password=xxxxx dbname=app",
+		"/var/lib/tenant1.db":                             "/var/lib/tenant1.db",
+	}
+
+	for dsn, expected := range cases {
+		if got := (config.Config{DSN: dsn}).RedactedDSN(); got != expected {
+			t.Errorf("RedactedDSN() of %q = %q, expected %q", dsn, got, expected)
+		}
+	}
+}
+
+func TestRunTargets(t *testing.T) {
+	dir := t.TempDir()
+	migrationDir := filepath.Join(dir, "data", "20240101000000")
+	if err := os.MkdirAll(migrationDir, 0755); err != nil {
+		t.Fatalf("Failed to create migration directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(migrationDir, "up.sql"), []byte("CREATE TABLE users (id INT);"), 0644); err != nil {
+		t.Fatalf("Failed to write up.sql: %v", err)
+	}
+
+	targetsFile := filepath.Join(dir, "targets.txt")
+	targetsList := "# tenants\n" + filepath.Join(dir, "t1.db") + "\n\n" + filepath.Join(dir, "missing", "t2.db") + "\n"
+	if err := os.WriteFile(targetsFile, []byte(targetsList), 0644); err != nil {
+		t.Fatalf("Failed to write targets file: %v", err)
+	}
+
+	cfg := config.Config{
+		TableName:   "migrations",
+		Path:        filepath.Join(dir, "data"),
+		DBType:      "sqlite",
+		Targets:     targetsFile,
+		Concurrency: 2,
+		Command:     "up",
+		Commands:    config.Commands{Steps: -1},
+	}
+
+	targets, err := loadTargets(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Failed to load targets: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(targets))
+	}
+
+	results := runTargets(context.Background(), targets, cfg)
+	if results[0].Status != targetOK {
+		t.Fatalf("Expected first target to succeed, got %s: %v", results[0].Status, results[0].Err)
+	}
+	if results[1].Status != targetFailed {
+		t.Fatalf("Expected second target to fail, got %s", results[1].Status)
+	}
+}
+
+func TestRunFanOutProtection(t *testing.T) {
+	dir := t.TempDir()
+	targetsFile := filepath.Join(dir, "targets.txt")
+	targetsList := filepath.Join(dir, "t1.db") + "\n" + filepath.Join(dir, "t2.db") + "\n"
+	if err := os.WriteFile(targetsFile, []byte(targetsList), 0644); err != nil {
+		t.Fatalf("Failed to write targets file: %v", err)
+	}
+
+	cfg := config.Config{
+		TableName:   "migrations",
+		Path:        dir,
+		DBType:      "sqlite",
+		Targets:     targetsFile,
+		Concurrency: 2,
+		Env:         "prod",
+		Protection:  "confirm",
+		Command:     "down",
+		Commands:    config.Commands{Steps: -1, Missing: "error", Yes: true},
+		Output:      &bytes.Buffer{},
+	}
+
+	if code := runFanOut(context.Background(), cfg); code != exitError {
+		t.Fatalf("Expected a protected environment to need -confirm for several targets, got exit code %d", code)
+	}
+
+	cfg.Env, cfg.Commands.Confirm = "", "t1"
+	if code := runFanOut(context.Background(), cfg); code != exitError {
+		t.Fatalf("Expected a protected run against several targets to need -env, got exit code %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "t1.db")); err == nil {
+		t.Fatal("Expected no target to be touched")
+	}
+}
+
+func TestLoadSchemaTargetsRequiresPostgres(t *testing.T) {
+	for _, dbType := range []string{"mysql", "sqlite"} {
+		cfg := config.Config{DBType: dbType, Schemas: "tenant_%"}
+		_, err := loadSchemaTargets(context.Background(), cfg)
+		if err == nil || !strings.Contains(err.Error(), "only supported for postgres") {
+			t.Errorf("Expected -schemas to be rejected for %s, got %v", dbType, err)
+		}
+	}
+}
+
+func TestParseCommands(t *testing.T) {
+	cases := []struct {
+		args    []string
+		command string
+		steps   int
+		desc    string
+		version string
+	}{
+		{args: []string{"up"}, command: "up", steps: -1},
+		{args: []string{"-db-table", "other", "down", "-step"}, command: "down", steps: 1},
+		{args: []string{"up", "-steps", "3"}, command: "up", steps: 3},
+		{args: []string{"redo"}, command: "redo", steps: 1},
+		{args: []string{"redo", "-steps", "2"}, command: "redo", steps: 2},
+		{args: []string{"mark-applied", "20240101000000", "-yes"}, command: "mark-applied", steps: -1, version: "20240101000000"},
+		{args: []string{"create", "Add", "users", "-script"}, command: "create", steps: -1, desc: "Add users"},
+		{args: []string{"status", "20240101000000"}, command: "status", steps: -1, version: "20240101000000"},
+		{args: []string{"-up", "-step"}, command: "up", steps: 1},
+		{args: []string{"-down", "-yes", "-missing", "skip"}, command: "down", steps: -1},
+		{args: []string{"-status", "20240101000000"}, command: "status", steps: -1, version: "20240101000000"},
+		{args: []string{"audit", "20240101000000", "-since", "2024-01-01"}, command: "audit", steps: -1, version: "20240101000000"},
+	}
+
+	for _, c := range cases {
+		cfg, err := config.Parse(c.args)
+		if err != nil {
+			t.Errorf("Parse(%q) returned error: %v", c.args, err)
+			continue
+		}
+		if cfg.Command != c.command || cfg.Commands.Steps != c.steps || cfg.Commands.Desc != c.desc || cfg.Commands.Version != c.version {
+			t.Errorf("Parse(%q) = %q steps=%d desc=%q version=%q", c.args, cfg.Command, cfg.Commands.Steps, cfg.Commands.Desc, cfg.Commands.Version)
+		}
+	}
+}
+
+func TestParseRejectsInvalidCommands(t *testing.T) {
+	cases := [][]string{
+		{},
+		{"-up", "-down"},
+		{"-up", "-yes"},
+		{"-up", "down"},
+		{"-history", "-script"},
+		{"up", "-step", "-steps", "2"},
+		{"up", "-steps", "0"},
+		{"up", "-script"},
+		{"history", "-debug"},
+		{"status", "-dry-run"},
+		{"-log-keep", "-1", "up"},
+		{"audit", "-since", "yesterday"},
+		{"audit", "-since", "2024-02-01", "-until", "2024-01-01"},
+		{"status", "-since", "2024-01-01"},
+		{"-log-level", "verbose", "up"},
+		{"-log-format", "xml", "up"},
+		{"-output", "xml", "status"},
+		{"mark-applied"},
+		{"up", "-yes"},
+		{"baseline"},
+		{"status", "-force"},
+		{"-out-of-order", "never", "up"},
+		{"-protection", "maybe", "down"},
+		{"-interpreters", "py", "up"},
+		{"-script-env", "BAD-NAME", "up"},
+		{"-script-limits", "cpu=500ms", "up"},
+		{"-script-limits", "disk=1G", "up"},
+		{"up", "-confirm", "prod"},
+		{"status", "-yes"},
+		{"up", "-missing", "skip"},
+		{"down", "-missing", "ignore"},
+		{"status", "a", "b"},
+		{"-steps", "2", "up"},
+		{"unknown"},
+	}
+
+	for _, args := range cases {
+		if _, err := config.Parse(args); err == nil {
+			t.Errorf("Parse(%q) expected an error", args)
+		}
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrate.yaml")
+	content := `default: dev
+environments:
+  dev:
+    db-host: localhost
+  prod:
+    db-host: ${PROD_HOST}
+    db-port: ${PROD_PORT:-5432}
+    db-user: file-user
+    db-name: file-name
+    connect-timeout: 30s
+    protection: confirm
+    script-env: AWS_*
+    script-limits: files=64,cpu=60s
+  literal:
+    db-password: 00123
+    db-name: 1e3
+    db-host: "on"
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	t.Setenv("PROD_HOST", "db.internal")
+	t.Setenv("DB_USER", "env-user")
+
+	cfg, err := config.Parse([]string{"-config", path, "-env", "prod", "history", "-db-name", "flag-name"})
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if cfg.Env != "prod" || cfg.Addr != "db.internal" || cfg.Port != "5432" || cfg.ConnectTimeout != 30*time.Second {
+		t.Fatalf("File settings not applied: %+v", cfg)
+	}
+	if cfg.User != "env-user" {
+		t.Fatalf("Expected the environment variable to override the file, got %q", cfg.User)
+	}
+	if cfg.DBName != "flag-name" {
+		t.Fatalf("Expected the flag to override the file, got %q", cfg.DBName)
+	}
+
+	cfg, err = config.Parse([]string{"-config=" + path, "history"})
+	if err != nil || cfg.Env != "dev" || cfg.Addr != "localhost" {
+		t.Fatalf("Expected the default environment, got %q %q (%v)", cfg.Env, cfg.Addr, err)
+	}
+
+	prod := []string{"-config", path, "-env", "prod", "down"}
+	if cfg, err := config.Parse(append([]string{"-protection", "deny"}, prod...)); err != nil || cfg.Protection != "deny" {
+		t.Fatalf("Expected -protection to raise the protection, got %q (%v)", cfg.Protection, err)
+	}
+	if _, err := config.Parse(append([]string{"-protection", "none"}, prod...)); err == nil {
+		t.Fatal("Expected -protection not to lower the protection of the environment")
+	}
+	t.Setenv("MIGRATION_PROTECTION", "none")
+	if _, err := config.Parse(prod); err == nil {
+		t.Fatal("Expected MIGRATION_PROTECTION not to lower the protection of the environment")
+	}
+	t.Setenv("MIGRATION_PROTECTION", "")
+
+	cfg, err = config.Parse(prod)
+	if err != nil || cfg.ScriptEnv.String() != "AWS_*" || cfg.ScriptLimits.Files != 64 || cfg.ScriptLimits.CPU != time.Minute {
+		t.Fatalf("Expected the script settings of the file, got %q %+v (%v)", cfg.ScriptEnv, cfg.ScriptLimits, err)
+	}
+	t.Setenv("MIGRATION_SCRIPT_ENV", "PGSSLMODE")
+	cfg, err = config.Parse(prod)
+	if err != nil || cfg.ScriptEnv.String() != "PGSSLMODE" {
+		t.Fatalf("Expected MIGRATION_SCRIPT_ENV to replace the file's list, got %q (%v)", cfg.ScriptEnv, err)
+	}
+	cfg, err = config.Parse(append([]string{"-script-env", "HTTP_PROXY", "-script-limits", "memory=1M"}, append(prod, "-script-env", "NO_PROXY")...))
+	if err != nil || cfg.ScriptEnv.String() != "HTTP_PROXY,NO_PROXY" || cfg.ScriptLimits != (config.ScriptLimits{Memory: 1 << 20}) {
+		t.Fatalf("Expected -script-env and -script-limits to replace the lower layers, got %q %+v (%v)", cfg.ScriptEnv, cfg.ScriptLimits, err)
+	}
+	t.Setenv("MIGRATION_SCRIPT_ENV", "")
+
+	for _, name := range []string{"DB_PASSWORD", "DB_NAME", "DB_HOST"} {
+		t.Setenv(name, "")
+	}
+	cfg, err = config.Parse([]string{"-config", path, "-env", "literal", "history"})
+	if err != nil || cfg.Passwd != "00123" || cfg.DBName != "1e3" || cfg.Addr != "on" {
+		t.Fatalf("Expected the values as written, got %q %q %q (%v)", cfg.Passwd, cfg.DBName, cfg.Addr, err)
+	}
+
+	if _, err := config.Parse([]string{"-config", path, "-env", "missing", "history"}); err == nil {
+		t.Fatalf("Expected an error for an unknown environment")
+	}
+}
+
+func TestPrepareMigrationTableAddsColumns(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	if _, err := database.Exec(fmt.Sprintf("DROP TABLE %s", testConfig.TableName)); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+	if _, err := database.Exec(fmt.Sprintf("CREATE TABLE %s (migration VARCHAR(255) NOT NULL PRIMARY KEY, applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)", testConfig.TableName)); err != nil {
+		t.Fatalf("Failed to create old table: %v", err)
+	}
+
+	if err := db.PrepareMigrationTable(context.Background(), database, testConfig); err != nil {
+		t.Fatalf("Failed to upgrade migration table: %v", err)
+	}
+
+	if err := handlers.AddMigration(context.Background(), database, testConfig, "22220101120001"); err != nil {
+		t.Fatalf("Failed to add migration to upgraded table: %v", err)
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	db := setupTestDB(t)
+	defer teardownTestDB(db)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	for _, version := range []string{"20240101000000", "20240102000000", "20240103000000"} {
+		writeMigration(t, cfg.Path, version, map[string]string{"up.sql": "SELECT 1;"})
+	}
+	writeMigration(t, cfg.Path, "20240103000000", map[string]string{"Add_users.txt": "## Add users\n"})
+
+	for _, version := range []string{"20240101000000", "20240102000000", "20231231000000"} {
+		if err := handlers.AddMigration(context.Background(), db, cfg, version); err != nil {
+			t.Fatalf("Failed to add migration: %v", err)
+		}
+	}
+	writeMigration(t, cfg.Path, "20240102000000", map[string]string{"up.sql": "SELECT 2;"})
+
+	statuses, err := handlers.LoadMigrationStatus(context.Background(), db, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load status: %v", err)
+	}
+
+	expected := map[string]string{
+		"20231231000000": handlers.StateMissing,
+		"20240101000000": handlers.StateApplied,
+		"20240102000000": handlers.StateModified,
+		"20240103000000": handlers.StatePending,
+	}
+	if len(statuses) != len(expected) {
+		t.Fatalf("Expected %d statuses, got %d", len(expected), len(statuses))
+	}
+	for _, s := range statuses {
+		if s.State != expected[s.Version] {
+			t.Errorf("Migration %s: expected %s, got %s", s.Version, expected[s.Version], s.State)
+		}
+	}
+
+	var out bytes.Buffer
+	cfg.Output = &out
+	cfg.Command = "status"
+	if err := handlers.HandleCommand(context.Background(), db, cfg); err != nil {
+		t.Fatalf("Status command failed: %v", err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("Add users")) || !bytes.Contains(out.Bytes(), []byte("Current version: 20240102000000")) {
+		t.Fatalf("Unexpected status output:\n%s", out.String())
+	}
+}
+
+func TestRunCommandReport(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"up.sql": "SELECT 1;"})
+	writeMigration(t, cfg.Path, "20240102000000", map[string]string{"up.sql": "SELECT * FROM no_such_table;"})
+
+	cfg.Output = &bytes.Buffer{}
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	report, err := handlers.RunCommand(context.Background(), database, cfg)
+	if err == nil {
+		t.Fatal("Expected the second migration to fail")
+	}
+
+	var out bytes.Buffer
+	if err := handlers.WriteReport(&out, "json", report); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+
+	var decoded struct {
+		Command    string `json:"command"`
+		Migrations []struct {
+			Version    string     `json:"version"`
+			State      string     `json:"state"`
+			AppliedAt  *time.Time `json:"applied_at"`
+			DurationMs *int64     `json:"duration_ms"`
+			Error      string     `json:"error"`
+		} `json:"migrations"`
+		Summary map[string]int `json:"summary"`
+		Error   string         `json:"error"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode report: %v\n%s", err, out.String())
+	}
+
+	if decoded.Command != "up" || decoded.Error == "" || len(decoded.Migrations) != 2 {
+		t.Fatalf("Unexpected report:\n%s", out.String())
+	}
+	applied, failed := decoded.Migrations[0], decoded.Migrations[1]
+	if applied.State != handlers.StateApplied || applied.AppliedAt == nil || applied.DurationMs == nil {
+		t.Errorf("Unexpected applied migration:\n%s", out.String())
+	}
+	if failed.State != handlers.StateFailed || failed.Error == "" || failed.AppliedAt != nil {
+		t.Errorf("Unexpected failed migration:\n%s", out.String())
+	}
+	if decoded.Summary[handlers.StateApplied] != 1 || decoded.Summary[handlers.StateFailed] != 1 {
+		t.Errorf("Unexpected summary: %v", decoded.Summary)
+	}
+}
+
+func TestRedoCommand(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	for _, version := range []string{"20240101000000", "20240102000000", "20240103000000"} {
+		table := "redo_" + version
+		writeMigration(t, cfg.Path, version, map[string]string{
+			"up.sql":   "CREATE TABLE " + table + " (id INTEGER);",
+			"down.sql": "DROP TABLE " + table + ";",
+		})
+	}
+
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up command failed: %v", err)
+	}
+
+	cfg.Command = "redo"
+	cfg.Commands.Steps = 2
+	cfg.Commands.Yes = true
+	report, err := handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Redo command failed: %v", err)
+	}
+
+	var order []string
+	for _, m := range report.Migrations {
+		order = append(order, m.State+" "+m.Version)
+	}
+	expected := []string{"reverted 20240103000000", "reverted 20240102000000", "applied 20240102000000", "applied 20240103000000"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, order)
+	}
+
+	// A migration that cannot be reverted stops the redo before anything
+	// is reapplied.
+	writeMigration(t, cfg.Path, "20240102000000", map[string]string{"down.sql": "DROP TABLE no_such_table;"})
+	if _, err := handlers.RunCommand(context.Background(), database, cfg); err == nil {
+		t.Fatal("Expected redo to fail")
+	}
+
+	pending, err := handlers.PendingMigrations(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load pending migrations: %v", err)
+	}
+	if fmt.Sprint(pending) != "[20240103000000]" {
+		t.Errorf("Expected only the reverted migration to be pending, got %v", pending)
+	}
+}
+
+func TestMarkCommands(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	version := "20240101000000"
+	writeMigration(t, cfg.Path, version, map[string]string{"up.sql": "CREATE TABLE never_created (id INTEGER);"})
+
+	cfg.Command = "mark-applied"
+	cfg.Commands.Version = version
+	cfg.Commands.Note = "applied by hand"
+	cfg.Input = strings.NewReader("n\n")
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil {
+		t.Fatal("Expected mark-applied to fail without confirmation")
+	}
+
+	cfg.Input = strings.NewReader("y\n")
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Mark-applied failed: %v", err)
+	}
+
+	historyMigrations, err := handlers.LoadHistoryMigrations(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load history: %v", err)
+	}
+	if len(historyMigrations) != 1 || historyMigrations[0].Status != handlers.RecordManual || historyMigrations[0].Note != "applied by hand" {
+		t.Fatalf("Unexpected history: %+v", historyMigrations)
+	}
+	if _, err := database.Exec("SELECT * FROM never_created"); err == nil {
+		t.Error("Expected mark-applied not to run the migration")
+	}
+
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil {
+		t.Error("Expected mark-applied to refuse an applied migration")
+	}
+
+	cfg.Command = "mark-unapplied"
+	cfg.Commands.Yes = true
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Mark-unapplied failed: %v", err)
+	}
+
+	pending, err := handlers.PendingMigrations(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load pending migrations: %v", err)
+	}
+	if len(pending) != 1 || pending[0] != version {
+		t.Errorf("Expected %s to be pending, got %v", version, pending)
+	}
+}
+
+func TestBaselineCommand(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	for _, version := range []string{"20240101000000", "20240102000000", "20240103000000"} {
+		writeMigration(t, cfg.Path, version, nil)
+	}
+
+	cfg.Command = "baseline"
+	cfg.Commands.Version = "20240102000000"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Baseline failed: %v", err)
+	}
+
+	historyMigrations, err := handlers.LoadHistoryMigrations(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load history: %v", err)
+	}
+	if len(historyMigrations) != 2 || historyMigrations[1].Migration != "20240102000000" || historyMigrations[1].Status != handlers.RecordBaselined {
+		t.Fatalf("Unexpected history: %+v", historyMigrations)
+	}
+
+	cfg.Commands.Version = "20240103000000"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil {
+		t.Fatal("Expected baseline to refuse a non-empty history")
+	}
+
+	cfg.Commands.Force = true
+	cfg.Commands.Yes = true
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Forced baseline failed: %v", err)
+	}
+
+	pending, err := handlers.PendingMigrations(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load pending migrations: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending migrations, got %v", pending)
+	}
+}
+
+func TestOutOfOrderPolicy(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	for _, version := range []string{"20240101000000", "20240102000000"} {
+		writeMigration(t, cfg.Path, version, map[string]string{"up.sql": "SELECT 1;"})
+	}
+	if err := handlers.AddMigration(context.Background(), database, cfg, "20240102000000"); err != nil {
+		t.Fatalf("Failed to add migration: %v", err)
+	}
+
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	cfg.OutOfOrder = "error"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil {
+		t.Fatal("Expected up to refuse an out-of-order migration")
+	}
+
+	statuses, err := handlers.LoadMigrationStatus(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load status: %v", err)
+	}
+	if !statuses[0].OutOfOrder || statuses[0].State != handlers.StatePending {
+		t.Fatalf("Expected %s to be pending out of order: %+v", statuses[0].Version, statuses[0])
+	}
+
+	var out bytes.Buffer
+	cfg.Output = &out
+	cfg.OutOfOrder = "warn"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if !strings.Contains(out.String(), `level=WARN msg="Pending migrations older than the latest applied one, applying them out of order"`) {
+		t.Errorf("Expected an out-of-order warning:\n%s", out.String())
+	}
+
+	pending, err := handlers.PendingMigrations(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load pending migrations: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending migrations, got %v", pending)
+	}
+}
+
+func TestDownWithMissingFiles(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	for _, version := range []string{"20240101000000", "20240102000000", "20240103000000"} {
+		writeMigration(t, cfg.Path, version, map[string]string{"down.sql": "SELECT 1;"})
+		if err := handlers.AddMigration(context.Background(), database, cfg, version); err != nil {
+			t.Fatalf("Failed to add migration: %v", err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(cfg.Path, "20240102000000")); err != nil {
+		t.Fatalf("Failed to remove migration: %v", err)
+	}
+
+	history := func() string {
+		historyMigrations, err := handlers.LoadHistoryMigrations(context.Background(), database, cfg)
+		if err != nil {
+			t.Fatalf("Failed to load history: %v", err)
+		}
+		var versions []string
+		for _, m := range historyMigrations {
+			versions = append(versions, m.Migration)
+		}
+		return strings.Join(versions, ",")
+	}
+
+	cfg.Command = "down"
+	cfg.Commands.Steps = -1
+	cfg.Commands.Missing = "error"
+	cfg.Commands.Yes = true
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil {
+		t.Fatal("Expected down to refuse missing migration files")
+	}
+	if got := history(); got != "20240101000000,20240102000000,20240103000000" {
+		t.Fatalf("Expected nothing to be reverted, history is %s", got)
+	}
+
+	cfg.Commands.Steps = 2
+	cfg.Commands.Missing = "skip"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Down with -missing skip failed: %v", err)
+	}
+	if got := history(); got != "20240101000000,20240102000000" {
+		t.Fatalf("Expected the missing migration to be kept, history is %s", got)
+	}
+
+	cfg.Commands.Missing = "purge"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Down with -missing purge failed: %v", err)
+	}
+	if got := history(); got != "" {
+		t.Fatalf("Expected an empty history, got %s", got)
+	}
+}
+
+func TestDownConfirmation(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	version := "20240101000000"
+	writeMigration(t, cfg.Path, version, map[string]string{"down.sql": "SELECT 1;"})
+	if err := handlers.AddMigration(context.Background(), database, cfg, version); err != nil {
+		t.Fatalf("Failed to add migration: %v", err)
+	}
+
+	cfg.Command = "down"
+	cfg.Commands.Steps = -1
+	cfg.Env = "prod"
+
+	cases := []struct {
+		protection string
+		yes        bool
+		confirm    string
+		input      string
+	}{
+		{protection: "none", input: "n\n"},
+		{protection: "none", input: ""},
+		{protection: "confirm", yes: true, input: "y\n"},
+		{protection: "confirm", input: "staging\n"},
+		{protection: "confirm", confirm: "staging"},
+		{protection: "deny", yes: true, confirm: "prod"},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		cfg.Output, cfg.Input = &out, strings.NewReader(c.input)
+		cfg.Protection, cfg.Commands.Yes, cfg.Commands.Confirm = c.protection, c.yes, c.confirm
+		if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil {
+			t.Fatalf("Expected down to be refused with %+v", c)
+		}
+		if c.protection != "deny" && c.confirm == "" && !strings.Contains(out.String(), "About to revert 1 migration(s) on environment prod") {
+			t.Errorf("Expected the plan to be shown with %+v:\n%s", c, out.String())
+		}
+	}
+
+	cfg.Output, cfg.Input = &bytes.Buffer{}, strings.NewReader("prod\n")
+	cfg.Protection, cfg.Commands.Yes, cfg.Commands.Confirm = "confirm", false, ""
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Down with the typed environment name failed: %v", err)
+	}
+
+	pending, err := handlers.PendingMigrations(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Failed to load pending migrations: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("Expected the migration to be reverted, pending: %v", pending)
+	}
+}
+
+func TestMigrationHooks(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	cfg.RunID = "test-run"
+	logPath := filepath.Join(cfg.Path, "hooks.log")
+
+	files := map[string]string{"up.sql": "SELECT 1;", "down.sql": "SELECT 1;"}
+	for _, phase := range []string{"pre-up", "post-up", "pre-down", "post-down"} {
+		files[phase+".sh"] = fmt.Sprintf("echo \"$MIGRATION_PHASE $MIGRATION_DIRECTION $MIGRATION_VERSION $MIGRATION_RUN_ID $DB_TYPE\" >> %s\n", logPath)
+	}
+	writeMigration(t, cfg.Path, "20240101000000", files)
+
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	cfg.Command = "down"
+	cfg.Commands.Yes = true
+	cfg.Commands.Missing = "error"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read hook log: %v", err)
+	}
+	want := fmt.Sprintf("pre-up up 20240101000000 test-run %[1]s\npost-up up 20240101000000 test-run %[1]s\n"+
+		"pre-down down 20240101000000 test-run %[1]s\npost-down down 20240101000000 test-run %[1]s\n", cfg.DBType)
+	if string(content) != want {
+		t.Fatalf("Unexpected hook runs:\n%s\nwant:\n%s", content, want)
+	}
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"up.sh": "true\n"})
+	cfg.Command = "up"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil || !strings.Contains(err.Error(), "pre-up") {
+		t.Fatalf("Expected up.sh next to pre-up.sh to be rejected, got %v", err)
+	}
+}
+
+func TestScriptInterpreters(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	if err := cfg.Interpreters.Set(".run=sh"); err != nil {
+		t.Fatalf("Failed to set interpreters: %v", err)
+	}
+	logPath := filepath.Join(cfg.Path, "scripts.log")
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{
+		"up.sql":        "SELECT 1;",
+		"down.sql":      "SELECT 1;",
+		"pre-up.script": "#!/bin/sh -e\necho shebang >> " + logPath + "\n",
+		"post-up.run":   "echo mapping >> " + logPath + "\n",
+		"pre-down.xyz":  "echo none >> " + logPath + "\n",
+	})
+
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	content, err := os.ReadFile(logPath)
+	if err != nil || string(content) != "shebang\nmapping\n" {
+		t.Fatalf("Unexpected script runs %q (%v)", content, err)
+	}
+
+	cfg.Command = "down"
+	cfg.Commands.Yes = true
+	cfg.Commands.Missing = "error"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil || !strings.Contains(err.Error(), "no interpreter") {
+		t.Fatalf("Expected a script without interpreter to fail, got %v", err)
+	}
+}
+
+func TestScriptOutputAndTimeout(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	output := &bytes.Buffer{}
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = output
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{
+		"up.sql":    "SELECT 1;",
+		"pre-up.sh": "echo first\necho second >&2\nexit 3\n",
+	})
+
+	err := handlers.HandleCommand(context.Background(), database, cfg)
+	if err == nil || !strings.Contains(err.Error(), "Last output:\nfirst\nsecond") {
+		t.Fatalf("Expected the output tail in the error, got %v", err)
+	}
+	if !strings.Contains(output.String(), "[20240101000000 pre-up] first\n[20240101000000 pre-up] second\n") {
+		t.Fatalf("Expected prefixed script output, got %q", output.String())
+	}
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"pre-up.sh": "sleep 30 &\nsleep 30\n"})
+	cfg.ScriptTimeout = 200 * time.Millisecond
+	start := time.Now()
+	err = handlers.HandleCommand(context.Background(), database, cfg)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Fatalf("Expected the script to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the script and its children to be killed, took %s", elapsed)
+	}
+}
+
+func TestScriptEnvironment(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	if err := cfg.ScriptEnv.Set("CUSTOM_*"); err != nil {
+		t.Fatalf("Failed to set script env: %v", err)
+	}
+	if err := cfg.ScriptLimits.Set("files=64"); err != nil {
+		t.Fatalf("Failed to set script limits: %v", err)
+	}
+	t.Setenv("DB_PASSWORD", "secret")
+	t.Setenv("CUSTOM_SETTING", "passed")
+	cfg.DSN = "host=db user=app password=secret"
+
+	dir := filepath.Join(cfg.Path, "20240101000000")
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{
+		"up.sql":     "SELECT 1;",
+		"pre-up.sh":  "echo \"$(pwd) ${DB_PASSWORD:-none} $CUSTOM_SETTING $(ulimit -n) $DB_DSN\" > env.log\n",
+		"post-up.sh": "test -f env.log\n",
+	})
+
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "env.log"))
+	if err != nil {
+		t.Fatalf("Expected the script to run in the migration directory: %v", err)
+	}
+	want := dir + " none passed 64 host=db user=app password=xxxxx\n"
+	if string(content) != want {
+		t.Fatalf("Unexpected script environment %q, want %q", content, want)
+	}
+}
+
+func TestGlobalHooks(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	hooks := t.TempDir()
+	logPath := filepath.Join(hooks, "hooks.log")
+	cfg.BeforeAll = filepath.Join(hooks, "before.sh")
+	cfg.AfterAll = filepath.Join(hooks, "after.sh")
+	if err := os.WriteFile(cfg.AfterAll, []byte("echo \"after $MIGRATION_COMMAND $MIGRATION_RESULT $MIGRATION_COUNT\" >> "+logPath+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write after hook: %v", err)
+	}
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"up.sql": "SELECT 1;"})
+	writeMigration(t, cfg.Path, "20240102000000", map[string]string{"up.sql": "SELECT * FROM no_such_table;"})
+
+	readLog := func() string {
+		content, _ := os.ReadFile(logPath)
+		os.Remove(logPath)
+		return string(content)
+	}
+
+	if err := os.WriteFile(cfg.BeforeAll, []byte("exit 1\n"), 0644); err != nil {
+		t.Fatalf("Failed to write before hook: %v", err)
+	}
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil || !strings.Contains(err.Error(), "before-all") {
+		t.Fatalf("Expected the failing before-all hook to abort, got %v", err)
+	}
+	if got := readLog(); got != "" {
+		t.Fatalf("Expected nothing to run after the before-all hook failed, got %q", got)
+	}
+
+	for _, script := range []string{"exit 75\n", "exit 77\n", "echo 'migrate:skip nothing to do'\n"} {
+		if err := os.WriteFile(cfg.BeforeAll, []byte(script), 0644); err != nil {
+			t.Fatalf("Failed to write before hook: %v", err)
+		}
+		if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil || !strings.Contains(err.Error(), "before-all") {
+			t.Fatalf("Expected the before-all hook running %q to abort, got %v", script, err)
+		}
+		if got := readLog(); got != "" {
+			t.Fatalf("Expected nothing to run after the before-all hook running %q, got %q", script, got)
+		}
+	}
+
+	if err := os.WriteFile(cfg.BeforeAll, []byte("echo \"before $MIGRATION_PLAN\" >> "+logPath+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write before hook: %v", err)
+	}
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil {
+		t.Fatal("Expected the second migration to fail")
+	}
+	if got, want := readLog(), "before 20240101000000 20240102000000\nafter up failure 2\n"; got != want {
+		t.Fatalf("Unexpected hook runs %q, want %q", got, want)
+	}
+
+	if err := os.RemoveAll(filepath.Join(cfg.Path, "20240102000000")); err != nil {
+		t.Fatalf("Failed to remove migration: %v", err)
+	}
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if got := readLog(); got != "" {
+		t.Fatalf("Expected no hooks without migrations to run, got %q", got)
+	}
+}
+
+func TestScriptSkipAndDefer(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+
+	scripts := map[string]string{
+		"20240101000000": "echo 'migrate:skip no rows to fix'\n",
+		"20240102000000": "exit 75\n",
+		"20240103000000": "exit 0\n",
+	}
+	for version, script := range scripts {
+		writeMigration(t, cfg.Path, version, map[string]string{
+			"up.sql":    "CREATE TABLE t_" + version + " (id INT);",
+			"pre-up.sh": script,
+		})
+	}
+	defer database.Exec("DROP TABLE IF EXISTS t_20240103000000")
+
+	report, err := handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	var states []string
+	for _, m := range report.Migrations {
+		states = append(states, m.State+":"+m.Note)
+	}
+	if got := strings.Join(states, ","); got != "skipped:no rows to fix,deferred:,applied:" {
+		t.Fatalf("Unexpected states %s", got)
+	}
+
+	for _, table := range []string{"t_20240101000000", "t_20240102000000"} {
+		if _, err := database.Exec("SELECT COUNT(*) FROM " + table); err == nil {
+			t.Fatalf("Expected the SQL creating %s not to run", table)
+		}
+	}
+
+	pending, err := handlers.PendingMigrations(context.Background(), database, cfg)
+	if err != nil || strings.Join(pending, ",") != "20240102000000" {
+		t.Fatalf("Expected the deferred migration to stay pending, got %v (%v)", pending, err)
+	}
+
+	writeMigration(t, cfg.Path, "20240102000000", map[string]string{"pre-up.sh": "exit 0\n"})
+	defer database.Exec("DROP TABLE IF EXISTS t_20240102000000")
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up of the deferred migration failed: %v", err)
+	}
+	historyMigrations, err := handlers.LoadHistoryMigrations(context.Background(), database, cfg)
+	if err != nil || len(historyMigrations) != 3 || historyMigrations[1].Status != "" {
+		t.Fatalf("Expected the deferred entry to be replaced, got %+v (%v)", historyMigrations, err)
+	}
+}
+
+func TestRevertSkippedMigration(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	logPath := filepath.Join(cfg.Path, "scripts.log")
+
+	if _, err := database.Exec("CREATE TABLE kept_data (id INTEGER)"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	defer database.Exec("DROP TABLE IF EXISTS kept_data")
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{
+		"up.sql":      "CREATE TABLE kept_data (id INTEGER);",
+		"down.sql":    "DROP TABLE kept_data;",
+		"pre-up.sh":   "echo 'migrate:skip already there'\n",
+		"pre-down.sh": "echo pre-down >> " + logPath + "\n",
+	})
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	cfg.Command = "down"
+	cfg.Commands.Yes = true
+	cfg.Commands.Missing = "error"
+	cfg.Commands.DryRun = true
+	report, err := handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil || len(report.Migrations) != 1 || len(report.Migrations[0].Steps) != 1 || !strings.Contains(report.Migrations[0].Steps[0], "down.sql is not run") {
+		t.Fatalf("Expected the dry run to only remove the entry, got %+v (%v)", report.Migrations, err)
+	}
+
+	cfg.Commands.DryRun = false
+	report, err = handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if len(report.Migrations) != 1 || report.Migrations[0].State != handlers.StateReverted || !strings.Contains(report.Migrations[0].Note, "down.sql not run") {
+		t.Fatalf("Unexpected report %+v", report.Migrations)
+	}
+	if _, err := database.Exec("SELECT COUNT(*) FROM kept_data"); err != nil {
+		t.Fatalf("Expected down.sql of the skipped migration not to run: %v", err)
+	}
+	if _, err := os.Stat(logPath); err == nil {
+		t.Fatal("Expected the pre-down script of the skipped migration not to run")
+	}
+	if pending, err := handlers.PendingMigrations(context.Background(), database, cfg); err != nil || len(pending) != 1 {
+		t.Fatalf("Expected the migration to be removed from the history, pending %v (%v)", pending, err)
+	}
+
+	events, err := handlers.LoadAuditEvents(context.Background(), database, cfg, "20240101000000", time.Time{}, time.Time{})
+	if err != nil || len(events) != 2 || events[1].Event != handlers.EventRevert || events[1].Outcome != handlers.StateReverted {
+		t.Fatalf("Expected the revert in the audit table, got %+v (%v)", events, err)
+	}
+}
+
+func TestScriptOrderAndDryRun(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	logPath := filepath.Join(cfg.Path, "order.log")
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{
+		"up.sql":    "SELECT 1;",
+		"down.sql":  "SELECT 1;",
+		"up.sh":     "echo \"up $MIGRATION_PHASE\" >> " + logPath + "\n",
+		"down.sh":   "echo \"down $MIGRATION_PHASE\" >> " + logPath + "\n",
+		"meta.yaml": "up:\n  script: both\ndown:\n  script: before\n",
+	})
+
+	cfg.Commands.DryRun = true
+	report, err := handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if len(report.Migrations) != 1 || strings.Join(report.Migrations[0].Steps, "; ") != "run up.sh (pre-up script); run up.sql (1 statement(s)); record in "+cfg.TableName+"; run up.sh (post-up script)" {
+		t.Fatalf("Unexpected plan %+v", report.Migrations)
+	}
+	if pending, err := handlers.PendingMigrations(context.Background(), database, cfg); err != nil || len(pending) != 1 {
+		t.Fatalf("Expected the dry run not to apply anything, pending %v (%v)", pending, err)
+	}
+	if _, err := os.Stat(logPath); err == nil {
+		t.Fatal("Expected the dry run not to run scripts")
+	}
+
+	cfg.Commands.DryRun = false
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	cfg.Command = "down"
+	cfg.Commands.Yes = true
+	cfg.Commands.Missing = "error"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+
+	content, err := os.ReadFile(logPath)
+	if err != nil || string(content) != "up pre-up\nup post-up\ndown pre-down\n" {
+		t.Fatalf("Unexpected script order %q (%v)", content, err)
+	}
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"meta.yaml": "up:\n  script: never\n"})
+	cfg.Command = "up"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil || !strings.Contains(err.Error(), "invalid script order") {
+		t.Fatalf("Expected an invalid meta.yaml to be rejected, got %v", err)
+	}
+}
+
+func TestExecutionLog(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	cfg.RunID = "test-run"
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"up.sql": "SELECT * FROM no_such_table;", "pre-up.sh": "echo checking rows\n"})
+
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err == nil {
+		t.Fatal("Expected the migration to fail")
+	}
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"up.sql": "SELECT 1;"})
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	executions, err := handlers.LoadExecutions(context.Background(), database, cfg, "20240101000000")
+	if err != nil {
+		t.Fatalf("Failed to load the execution log: %v", err)
+	}
+	if len(executions) != 2 || executions[0].Status != "applied" || executions[1].Status != "failed" {
+		t.Fatalf("Expected a failed and an applied run, got %+v", executions)
+	}
+	failed := executions[1]
+	if failed.RunID != "test-run" || failed.Direction != "up" || !strings.Contains(failed.Error, "no_such_table") ||
+		!strings.Contains(failed.Output, "[20240101000000 pre-up] checking rows") || !strings.Contains(failed.Output, "up.sql, 1 statement(s), failed") {
+		t.Fatalf("Unexpected failed run %+v", failed)
+	}
+
+	cfg.Command = "history"
+	cfg.Commands.Version = "20240101000000"
+	report, err := handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil || len(report.Migrations) != 1 || len(report.Migrations[0].Runs) != 2 {
+		t.Fatalf("Expected history to list both runs, got %+v (%v)", report, err)
+	}
+
+	cfg.LogKeep = 1
+	cfg.Command = "down"
+	cfg.Commands.Version = ""
+	cfg.Commands.Yes = true
+	cfg.Commands.Missing = "error"
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"down.sql": "SELECT 1;"})
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	executions, err = handlers.LoadExecutions(context.Background(), database, cfg, "20240101000000")
+	if err != nil || len(executions) != 1 || executions[0].Direction != "down" {
+		t.Fatalf("Expected only the latest run to be kept, got %+v (%v)", executions, err)
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &bytes.Buffer{}
+	cfg.ToolVersion = "v1.2.3"
+	cfg.RunID = "test-run"
+
+	for _, version := range []string{"20240101000000", "20240102000000"} {
+		writeMigration(t, cfg.Path, version, map[string]string{"up.sql": "SELECT 1;", "down.sql": "SELECT 1;"})
+	}
+
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	cfg.Command = "down"
+	cfg.Commands.Steps = 1
+	cfg.Commands.Yes = true
+	cfg.Commands.Missing = "error"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	cfg.Command = "mark-applied"
+	cfg.Commands.Version = "20240102000000"
+	cfg.Commands.Note = "applied by hand"
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Mark-applied failed: %v", err)
+	}
+
+	cfg.Command = "audit"
+	cfg.Commands.Version = ""
+	report, err := handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+	var got []string
+	for _, e := range report.Events {
+		got = append(got, e.Version+" "+e.Event+" "+e.Direction+" "+e.Outcome)
+	}
+	want := []string{
+		"20240101000000 apply up applied",
+		"20240102000000 apply up applied",
+		"20240102000000 revert down reverted",
+		"20240102000000 mark-applied up applied",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected audit entries %q, got %q", want, got)
+	}
+	last := report.Events[3]
+	if last.ToolVersion != "v1.2.3" || last.Command != "mark-applied" || last.RunID != "test-run" || last.Detail != "applied by hand" || last.Hostname == "" {
+		t.Fatalf("Unexpected audit entry %+v", last)
+	}
+
+	cfg.Commands.Version = "20240102000000"
+	cfg.Commands.Since = time.Now().Add(-time.Hour)
+	report, err = handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil || len(report.Events) != 3 {
+		t.Fatalf("Expected the 3 entries of the migration, got %+v (%v)", report.Events, err)
+	}
+
+	cfg.Commands.Since, cfg.Commands.Until = time.Time{}, time.Now().Add(-time.Hour)
+	report, err = handlers.RunCommand(context.Background(), database, cfg)
+	if err != nil || len(report.Events) != 0 {
+		t.Fatalf("Expected no entries before the run, got %+v (%v)", report.Events, err)
+	}
+}
+
+func TestStructuredLogging(t *testing.T) {
+	database := setupTestDB(t)
+	defer teardownTestDB(database)
+
+	var out bytes.Buffer
+	cfg := testConfig
+	cfg.Path = t.TempDir()
+	cfg.Output = &out
+	cfg.LogFormat = "json"
+	cfg.LogLevel = slog.LevelDebug
+	cfg.Command = "up"
+	cfg.Commands.Steps = -1
+
+	writeMigration(t, cfg.Path, "20240101000000", map[string]string{"up.sql": "SELECT 1; SELECT 2;", "pre-up.sh": "echo checking\n"})
+
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected a JSON log record, got %q: %v", line, err)
+		}
+		if record["msg"] == "Applying migrations" {
+			continue
+		}
+		if record["migration"] != "20240101000000" || record["direction"] != "up" {
+			t.Errorf("Expected the migration fields in %q", line)
+		}
+		messages = append(messages, fmt.Sprintf("%v %v %v", record["level"], record["msg"], record["statement"]))
+	}
+	want := []string{"INFO Script output <nil>", "DEBUG Statement executed 1", "DEBUG Statement executed 2", "INFO Migration applied <nil>"}
+	if strings.Join(messages, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected log messages %q, got %q", want, messages)
+	}
+
+	out.Reset()
+	cfg.LogLevel = slog.LevelWarn
+	cfg.Commands.Steps = -1
+	if err := handlers.HandleCommand(context.Background(), database, cfg); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Expected no messages below the warn level, got %q", out.String())
+	}
+}
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -14,53 +20,668 @@ type Config struct {
 	DBName    string
 	Path      string
 	DBType    string
-	Commands  Commands
+	DSN       string
+	Schema    string
+
+	// PasswdFile and PasswdCommand are read again whenever a new
+	// connection is opened, taking precedence over Passwd.
+	PasswdFile    string
+	PasswdCommand string
+
+	ConnectTimeout   time.Duration
+	Timeout          time.Duration
+	StatementTimeout time.Duration
+	ScriptTimeout    time.Duration
+
+	Targets      string
+	TargetsQuery string
+	Schemas      string
+	Concurrency  int
+	FailFast     bool
+
+	// ConfigFile and Env are the configuration file and its environment
+	// the settings were loaded from, if any.
+	ConfigFile string
+	Env        string
+
+	// OutOfOrder is what up does with pending migrations older than the
+	// newest applied one: error, warn or allow.
+	OutOfOrder string
+
+	// Protection guards the environment against down and redo: none,
+	// confirm (the environment name must be typed) or deny.
+	Protection string
+
+	// Format is the output format of the command's result: text, json
+	// or yaml.
+	Format string
+
+	// LogLevel is the lowest level of the messages logged, and LogFormat
+	// their format: text or json.
+	LogLevel  slog.Level
+	LogFormat string
+
+	// Log receives the command's messages; nil means a logger writing to
+	// Out(), see Logger.
+	Log *slog.Logger
+
+	// Interpreters runs migration scripts by file extension, taking
+	// precedence over their shebang line.
+	Interpreters Interpreters
+
+	// BeforeAll and AfterAll are scripts run once before and after the
+	// migrations of up, down and redo, when there are any to run.
+	BeforeAll string
+	AfterAll  string
+
+	// ScriptEnv lists the environment variables passed on to migration
+	// scripts in addition to DefaultScriptEnv, and ScriptLimits the
+	// resource limits of the scripts.
+	ScriptEnv    ScriptEnv
+	ScriptLimits ScriptLimits
+
+	// LogKeep is the number of entries kept in the execution log table;
+	// 0 keeps all of them.
+	LogKeep int
+
+	// RunID identifies this run of the tool to hook scripts.
+	RunID string
+
+	// ToolVersion is the version of the tool, recorded in the audit table.
+	ToolVersion string
+
+	// Output receives the command's messages; nil means standard output.
+	// Input answers confirmation prompts; nil means standard input.
+	Output io.Writer
+	Input  io.Reader
+
+	// Command is the subcommand to run, e.g. "up"; Commands holds its
+	// options.
+	Command  string
+	Commands Commands
 }
 
 type Commands struct {
-	History bool
-	New     bool
-	Up      bool
-	Down    bool
 	Debug   bool
 	Step    bool
 	Steps   int
-	Status  string
-	Create  bool
+	Version string
 	Script  bool
 	Desc    string
+	Yes     bool
+	Note    string
+	Force   bool
+	Missing string
+	Confirm string
+	DryRun  bool
+
+	// Since and Until limit the audit command to entries at or after Since
+	// and before Until; zero values do not limit.
+	Since time.Time
+	Until time.Time
+}
+
+// command describes a subcommand: its flags and how many positional
+// arguments it takes (-1 for any number).
+type command struct {
+	Name    string
+	Args    string
+	Summary string
+	MaxArgs int
+	Flags   func(fs *flag.FlagSet, c *Commands)
+}
+
+var commands = []command{
+	{Name: "up", Summary: "Apply new migrations", Flags: stepFlags},
+	{Name: "down", Summary: "Revert applied migrations, newest first", Flags: revertFlags},
+	{Name: "redo", Summary: "Revert and reapply the latest migrations (default 1)", Flags: revertFlags},
+	{Name: "baseline", Args: "<version>", Summary: "Record the migrations up to a version as applied without running them", MaxArgs: 1, Flags: baselineFlags},
+	{Name: "mark-applied", Args: "<version>", Summary: "Record a migration as applied without running it", MaxArgs: 1, Flags: markFlags},
+	{Name: "mark-unapplied", Args: "<version>", Summary: "Remove a migration from the history without reverting it", MaxArgs: 1, Flags: markFlags},
+	{Name: "create", Args: "[description]", Summary: "Create the files of an empty migration", MaxArgs: -1, Flags: createFlags},
+	{Name: "status", Args: "[version]", Summary: "Show the status of migrations", MaxArgs: 1},
+	{Name: "history", Args: "[version]", Summary: "Display migration history, or the runs of one migration", MaxArgs: 1},
+	{Name: "new", Summary: "Display upcoming migrations"},
+	{Name: "audit", Args: "[version]", Summary: "Display the audit trail of every change of the history", MaxArgs: 1, Flags: auditFlags},
+}
+
+// legacyCommands are the command flags accepted before subcommands existed.
+var legacyCommands = []string{"up", "down", "create", "status", "history", "new"}
+
+// envVars maps global flags to the environment variables providing their
+// default values.
+var envVars = map[string]string{
+	"db-user":             "DB_USER",
+	"db-password":         "DB_PASSWORD",
+	"db-password-file":    "DB_PASSWORD_FILE",
+	"db-password-command": "DB_PASSWORD_COMMAND",
+	"db-host":             "DB_HOST",
+	"db-port":             "DB_PORT",
+	"db-name":             "DB_NAME",
+	"db-table":            "DB_TABLE",
+	"path":                "MIGRATION_PATH",
+	"db-type":             "DB_TYPE",
+	"db-dsn":              "DB_DSN",
+	"db-schema":           "DB_SCHEMA",
+	"connect-timeout":     "DB_CONNECT_TIMEOUT",
+	"timeout":             "MIGRATION_TIMEOUT",
+	"statement-timeout":   "MIGRATION_STATEMENT_TIMEOUT",
+	"script-timeout":      "MIGRATION_SCRIPT_TIMEOUT",
+	"targets":             "MIGRATION_TARGETS",
+	"targets-query":       "MIGRATION_TARGETS_QUERY",
+	"schemas":             "MIGRATION_SCHEMAS",
+	"concurrency":         "MIGRATION_CONCURRENCY",
+	"config":              "MIGRATION_CONFIG",
+	"env":                 "MIGRATION_ENV",
+	"output":              "MIGRATION_OUTPUT",
+	"log-level":           "MIGRATION_LOG_LEVEL",
+	"log-format":          "MIGRATION_LOG_FORMAT",
+	"out-of-order":        "MIGRATION_OUT_OF_ORDER",
+	"protection":          "MIGRATION_PROTECTION",
+	"interpreters":        "MIGRATION_INTERPRETERS",
+	"before-all":          "MIGRATION_BEFORE_ALL",
+	"after-all":           "MIGRATION_AFTER_ALL",
+	"log-keep":            "MIGRATION_LOG_KEEP",
+	"script-env":          "MIGRATION_SCRIPT_ENV",
+	"script-limits":       "MIGRATION_SCRIPT_LIMITS",
+}
+
+// globalFlags registers the flags shared by every command. The current
+// values of config are the defaults, so registering again on a command's
+// flag set keeps what was already parsed.
+func globalFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.ConfigFile, "config", config.ConfigFile, "Configuration file with named environments (default "+DefaultConfigFile+" if it exists)")
+	fs.StringVar(&config.Env, "env", config.Env, "Environment of the configuration file to use")
+	fs.StringVar(&config.User, "db-user", config.User, "Database user")
+	fs.StringVar(&config.Passwd, "db-password", config.Passwd, "Database password")
+	fs.StringVar(&config.PasswdFile, "db-password-file", config.PasswdFile, "File containing the database password")
+	fs.StringVar(&config.PasswdCommand, "db-password-command", config.PasswdCommand, "Shell command printing the database password, run for every new connection")
+	fs.StringVar(&config.Addr, "db-host", config.Addr, "Database host address")
+	fs.StringVar(&config.Port, "db-port", config.Port, "Database port")
+	fs.StringVar(&config.DBName, "db-name", config.DBName, "Database name")
+	fs.StringVar(&config.TableName, "db-table", config.TableName, "Migration table")
+	fs.StringVar(&config.Path, "path", config.Path, "Migration dir")
+	fs.StringVar(&config.DBType, "db-type", config.DBType, "Database type (mysql, sqlite, postgres)")
+	fs.StringVar(&config.DSN, "db-dsn", config.DSN, "Database connection string, used instead of the separate connection flags")
+	fs.StringVar(&config.Schema, "db-schema", config.Schema, "Postgres schema holding the migration table and migrated objects")
+	fs.StringVar(&config.Format, "output", config.Format, "Output format of the result (text, json, yaml)")
+	fs.TextVar(&config.LogLevel, "log-level", config.LogLevel, "Lowest level of the messages logged (debug, info, warn, error)")
+	fs.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Format of the messages logged (text, json)")
+	fs.StringVar(&config.OutOfOrder, "out-of-order", config.OutOfOrder, "What up does with pending migrations older than the newest applied one (error, warn, allow)")
+	fs.StringVar(&config.Protection, "protection", config.Protection, "Protection of the environment against down and redo (none, confirm, deny)")
+	fs.Var(&config.Interpreters, "interpreters", "Interpreters of migration scripts by extension, e.g. .py=python3,.js=node (default: the script's shebang line)")
+	fs.StringVar(&config.BeforeAll, "before-all", config.BeforeAll, "Script run once before up, down or redo runs any migration, e.g. to take a backup; its failure aborts the run")
+	fs.StringVar(&config.AfterAll, "after-all", config.AfterAll, "Script run once after up, down or redo ran migrations, with the result in MIGRATION_RESULT")
+	fs.Var(&config.ScriptEnv, "script-env", "Environment variables passed on to migration scripts besides PATH, HOME, locale and the like, e.g. AWS_*,PGSSLMODE")
+	fs.Var(&config.ScriptLimits, "script-limits", "Resource limits of migration scripts, e.g. cpu=60s,memory=512M,files=256 (Unix only)")
+	fs.DurationVar(&config.ConnectTimeout, "connect-timeout", config.ConnectTimeout, "How long to keep retrying the database connection (e.g. 30s, 0 disables retries)")
+	fs.DurationVar(&config.Timeout, "timeout", config.Timeout, "Overall time limit for the command (0 means no limit)")
+	fs.DurationVar(&config.StatementTimeout, "statement-timeout", config.StatementTimeout, "Time limit for a single SQL statement (0 means no limit)")
+	fs.DurationVar(&config.ScriptTimeout, "script-timeout", config.ScriptTimeout, "Time limit for a single migration script, killing it and its children (0 means no limit)")
+
+	fs.StringVar(&config.Targets, "targets", config.Targets, "File with one database connection string per line to run the command against")
+	fs.StringVar(&config.TargetsQuery, "targets-query", config.TargetsQuery, "Query returning connection strings of the databases to run the command against")
+	fs.StringVar(&config.Schemas, "schemas", config.Schemas, "Postgres schema name pattern (SQL LIKE) to run the command against every matching schema")
+	fs.IntVar(&config.LogKeep, "log-keep", config.LogKeep, "Number of entries kept in the execution log table (0 keeps all)")
+	fs.IntVar(&config.Concurrency, "concurrency", config.Concurrency, "Number of targets migrated at the same time")
+	fs.BoolVar(&config.FailFast, "fail-fast", config.FailFast, "Stop migrating the remaining targets after the first failure")
+}
+
+func stepFlags(fs *flag.FlagSet, c *Commands) {
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "Log the SQL of every migration, same as -log-level debug")
+	fs.BoolVar(&c.Step, "step", c.Step, "Only one step migration")
+	fs.IntVar(&c.Steps, "steps", c.Steps, "Number of migrations to apply, revert or redo (default all, 1 for redo)")
+	fs.BoolVar(&c.DryRun, "dry-run", c.DryRun, "Print what would be run, in order, without changing anything")
+}
+
+func revertFlags(fs *flag.FlagSet, c *Commands) {
+	stepFlags(fs, c)
+	fs.StringVar(&c.Missing, "missing", c.Missing, "What to do with applied migrations whose files are missing (error, skip, purge)")
+	fs.BoolVar(&c.Yes, "yes", c.Yes, "Do not ask for confirmation")
+	fs.StringVar(&c.Confirm, "confirm", c.Confirm, "Name of the protected environment, confirming the command without a prompt")
+}
+
+func createFlags(fs *flag.FlagSet, c *Commands) {
+	fs.BoolVar(&c.Script, "script", c.Script, "Create bash scripts for the migration")
+	fs.StringVar(&c.Desc, "desc", c.Desc, "Description of the migration (same as the argument)")
+}
+
+func markFlags(fs *flag.FlagSet, c *Commands) {
+	fs.BoolVar(&c.Yes, "yes", c.Yes, "Do not ask for confirmation")
+	fs.StringVar(&c.Note, "note", c.Note, "Reason for the change, stored in the history")
+}
+
+func baselineFlags(fs *flag.FlagSet, c *Commands) {
+	fs.BoolVar(&c.Force, "force", c.Force, "Baseline even though the history is not empty")
+	fs.BoolVar(&c.Yes, "yes", c.Yes, "Do not ask for confirmation")
+}
+
+func auditFlags(fs *flag.FlagSet, c *Commands) {
+	fs.Func("since", "Only entries at or after this date or time, e.g. 2024-01-31 or 2024-01-31T15:04:05Z", func(value string) error {
+		t, _, err := parseTime(value)
+		c.Since = t
+		return err
+	})
+	fs.Func("until", "Only entries before this time, or up to the end of this date", func(value string) error {
+		t, dateOnly, err := parseTime(value)
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		c.Until = t
+		return err
+	})
+}
+
+// parseTime reads a date or time in local time unless it has a zone, and
+// reports whether it is a date without a time.
+func parseTime(value string) (t time.Time, dateOnly bool, err error) {
+	if t, err = time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err = time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, false, nil
+		}
+	}
+	if t, err = time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid date %q, use e.g. 2024-01-31 or 2024-01-31T15:04:05Z", value)
 }
 
+// ParseFlags parses the command line and exits with usage on invalid input.
 func ParseFlags() Config {
-	var config Config
-
-	flag.StringVar(&config.User, "db-user", os.Getenv("DB_USER"), "Database user")
-	flag.StringVar(&config.Passwd, "db-password", os.Getenv("DB_PASSWORD"), "Database password")
-	flag.StringVar(&config.Addr, "db-host", os.Getenv("DB_HOST"), "Database host address")
-	flag.StringVar(&config.Port, "db-port", os.Getenv("DB_PORT"), "Database port")
-	flag.StringVar(&config.DBName, "db-name", os.Getenv("DB_NAME"), "Database name")
-	flag.StringVar(&config.TableName, "db-table", os.Getenv("DB_TABLE"), "Migration table")
-	flag.StringVar(&config.Path, "path", os.Getenv("MIGRATION_PATH"), "Migration dir")
-	flag.StringVar(&config.DBType, "db-type", os.Getenv("DB_TYPE"), "Database type (mysql, sqlite, postgres)")
-
-	flag.StringVar(&config.Commands.Status, "status", "", "Check the status of a specific migration")
-	flag.StringVar(&config.Commands.Desc, "desc", "", "Create a description of empty migration")
-	flag.BoolVar(&config.Commands.Script, "script", false, "Create a bash scripts of empty migration")
-	flag.BoolVar(&config.Commands.Create, "create", false, "Create a files of empty migration")
-	flag.BoolVar(&config.Commands.History, "history", false, "Display migration history")
-	flag.BoolVar(&config.Commands.New, "new", false, "Display upcoming migrations")
-	flag.BoolVar(&config.Commands.Up, "up", false, "Apply new migrations")
-	flag.BoolVar(&config.Commands.Down, "down", false, "Revert migrations")
-	flag.BoolVar(&config.Commands.Debug, "debug", false, "Debug migrations")
-	flag.BoolVar(&config.Commands.Step, "step", false, "Only one step migration")
-	flag.IntVar(&config.Commands.Steps, "steps", -1, "Number of steps")
-
-	flag.Parse()
-
-	if config.Commands.Step {
-		config.Commands.Steps = 1
-		println(config.Commands.Steps)
+	config, err := Parse(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\nRun 'migrate -h' for usage.\n", err)
+		os.Exit(2)
 	}
 
 	return config
 }
+
+// Parse reads a command line of the form
+//
+//	migrate [global flags] <command> [command flags] [arguments]
+//
+// Global flags may also follow the command. Settings are taken from flags,
+// then environment variables, then the selected environment of the
+// configuration file, then built-in defaults. The legacy form with command
+// flags such as -up is still accepted, with a deprecation warning.
+func Parse(args []string) (Config, error) {
+	config := Config{Concurrency: 4, LogKeep: 1000, Format: "text", LogFormat: "text", OutOfOrder: "warn", Protection: "none", Commands: Commands{Steps: -1, Missing: "error"}}
+
+	path, explicit := lookupArg(args, "config")
+	if !explicit {
+		path, explicit = os.Getenv(envVars["config"]), os.Getenv(envVars["config"]) != ""
+	}
+	if !explicit {
+		path = DefaultConfigFile
+	}
+	envName, ok := lookupArg(args, "env")
+	if !ok {
+		envName = os.Getenv(envVars["env"])
+	}
+	if err := loadFile(&config, path, envName, explicit); err != nil {
+		return config, err
+	}
+	fileProtection := config.Protection
+
+	env := flag.NewFlagSet("env", flag.ContinueOnError)
+	globalFlags(env, &config)
+	keepLists := clearLists(&config)
+	for name, key := range envVars {
+		if value := os.Getenv(key); value != "" {
+			if err := env.Set(name, value); err != nil {
+				return config, fmt.Errorf("invalid %s: %v", key, err)
+			}
+		}
+	}
+	keepLists(setFlags(env))
+
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	globalFlags(fs, &config)
+	legacy := make(map[string]*bool)
+	for _, name := range legacyCommands {
+		if name != "status" {
+			legacy[name] = fs.Bool(name, false, "Deprecated: use the '"+name+"' command")
+		}
+	}
+	status := fs.String("status", "", "Deprecated: use the 'status' command")
+	revertFlags(fs, &config.Commands)
+	createFlags(fs, &config.Commands)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+
+	keepLists = clearLists(&config)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			usage()
+		}
+		return config, err
+	}
+	if err := checkProtection(config, fileProtection); err != nil {
+		return config, err
+	}
+
+	var used []string
+	for _, name := range legacyCommands {
+		if (name == "status" && *status != "") || (name != "status" && *legacy[name]) {
+			used = append(used, name)
+		}
+	}
+
+	if len(used) > 0 {
+		if fs.NArg() > 0 {
+			return config, fmt.Errorf("cannot combine the -%s flag with the '%s' command", used[0], fs.Arg(0))
+		}
+		if len(used) > 1 {
+			return config, fmt.Errorf("conflicting commands: -%s", strings.Join(used, ", -"))
+		}
+		config.Command = used[0]
+		config.Commands.Version = *status
+		config.NewLogger(os.Stderr).Warn(fmt.Sprintf("The -%s flag is deprecated, use 'migrate %s' instead", config.Command, config.Command))
+		keepLists(setFlags(fs))
+		return config, validate(&config, setFlags(fs))
+	}
+
+	if fs.NArg() == 0 {
+		usage()
+		return config, fmt.Errorf("no command specified")
+	}
+
+	set := setFlags(fs)
+	globals := globalFlagNames()
+	for name := range set {
+		if !globals[name] {
+			return config, fmt.Errorf("the -%s flag must follow the command", name)
+		}
+	}
+
+	spec, ok := findCommand(fs.Arg(0))
+	if !ok {
+		return config, fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+	config.Command = spec.Name
+
+	cmdFlags := flag.NewFlagSet(spec.Name, flag.ContinueOnError)
+	globalFlags(cmdFlags, &config)
+	if spec.Flags != nil {
+		spec.Flags(cmdFlags, &config.Commands)
+	}
+	cmdFlags.SetOutput(io.Discard)
+	cmdFlags.Usage = func() {}
+
+	positional, err := parseInterspersed(cmdFlags, fs.Args()[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			commandUsage(spec)
+		}
+		return config, err
+	}
+	if spec.MaxArgs >= 0 && len(positional) > spec.MaxArgs {
+		return config, fmt.Errorf("too many arguments for '%s': %s", spec.Name, strings.Join(positional, " "))
+	}
+
+	switch spec.Name {
+	case "create":
+		if len(positional) > 0 {
+			if config.Commands.Desc != "" {
+				return config, fmt.Errorf("give the description either as an argument or with -desc, not both")
+			}
+			config.Commands.Desc = strings.Join(positional, " ")
+		}
+	case "status", "history", "audit":
+		if len(positional) > 0 {
+			config.Commands.Version = positional[0]
+		}
+	case "baseline", "mark-applied", "mark-unapplied":
+		if len(positional) == 0 {
+			return config, fmt.Errorf("'%s' requires the version of the migration", spec.Name)
+		}
+		config.Commands.Version = positional[0]
+	}
+
+	for name := range setFlags(cmdFlags) {
+		set[name] = true
+	}
+	keepLists(set)
+	return config, validate(&config, set)
+}
+
+// clearLists empties the settings that add to their value on every Set,
+// so that a layer of settings replaces them rather than adding to what the
+// layers below set. The returned function restores the value from below
+// of those the layer did not set.
+func clearLists(config *Config) func(set map[string]bool) {
+	env, limits := config.ScriptEnv, config.ScriptLimits
+	config.ScriptEnv, config.ScriptLimits = nil, ScriptLimits{}
+	return func(set map[string]bool) {
+		if !set["script-env"] {
+			config.ScriptEnv = env
+		}
+		if !set["script-limits"] {
+			config.ScriptLimits = limits
+		}
+	}
+}
+
+// protectionLevels orders the -protection values from the weakest.
+var protectionLevels = map[string]int{"none": 0, "confirm": 1, "deny": 2}
+
+// checkProtection rejects a -protection flag or MIGRATION_PROTECTION that
+// lowers the protection the configuration file sets for the environment,
+// so that a protected environment cannot be reverted by overriding it.
+// They may raise it.
+func checkProtection(config Config, fileProtection string) error {
+	if level, ok := protectionLevels[config.Protection]; ok && level < protectionLevels[fileProtection] {
+		return fmt.Errorf("protection %q cannot lower the protection %q of environment %q set in %s", config.Protection, fileProtection, config.Env, config.ConfigFile)
+	}
+	return nil
+}
+
+// validate rejects options that do not apply to the command or contradict
+// each other.
+func validate(config *Config, set map[string]bool) error {
+	switch config.Format {
+	case "text", "json", "yaml":
+	default:
+		return fmt.Errorf("invalid output format %q, use text, json or yaml", config.Format)
+	}
+	switch config.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid -log-format %q, use text or json", config.LogFormat)
+	}
+	switch config.OutOfOrder {
+	case "error", "warn", "allow":
+	default:
+		return fmt.Errorf("invalid -out-of-order policy %q, use error, warn or allow", config.OutOfOrder)
+	}
+
+	isStep := config.Command == "up" || config.Command == "down" || config.Command == "redo"
+	for _, name := range []string{"step", "steps", "debug", "dry-run"} {
+		if set[name] && !isStep {
+			return fmt.Errorf("-%s can only be used with up, down or redo", name)
+		}
+	}
+	for _, name := range []string{"script", "desc"} {
+		if set[name] && config.Command != "create" {
+			return fmt.Errorf("-%s can only be used with create", name)
+		}
+	}
+	if set["missing"] {
+		if config.Command != "down" && config.Command != "redo" {
+			return fmt.Errorf("-missing can only be used with down or redo")
+		}
+		switch config.Commands.Missing {
+		case "error", "skip", "purge":
+		default:
+			return fmt.Errorf("invalid -missing policy %q, use error, skip or purge", config.Commands.Missing)
+		}
+	}
+	if set["force"] && config.Command != "baseline" {
+		return fmt.Errorf("-force can only be used with baseline")
+	}
+	isMark := config.Command == "mark-applied" || config.Command == "mark-unapplied"
+	if set["note"] && !isMark {
+		return fmt.Errorf("-note can only be used with mark-applied or mark-unapplied")
+	}
+	isRevert := config.Command == "down" || config.Command == "redo"
+	if set["yes"] && !isMark && !isRevert && config.Command != "baseline" {
+		return fmt.Errorf("-yes can only be used with down, redo, baseline, mark-applied or mark-unapplied")
+	}
+	if set["confirm"] && !isRevert {
+		return fmt.Errorf("-confirm can only be used with down or redo")
+	}
+	switch config.Protection {
+	case "none", "confirm", "deny":
+	default:
+		return fmt.Errorf("invalid -protection %q, use none, confirm or deny", config.Protection)
+	}
+
+	if set["step"] && set["steps"] {
+		return fmt.Errorf("-step and -steps cannot be used together")
+	}
+	if !config.Commands.Since.IsZero() && !config.Commands.Until.IsZero() && !config.Commands.Until.After(config.Commands.Since) {
+		return fmt.Errorf("-until must be after -since")
+	}
+	if config.LogKeep < 0 {
+		return fmt.Errorf("-log-keep must not be negative")
+	}
+	if set["steps"] && config.Commands.Steps < 1 {
+		return fmt.Errorf("-steps must be at least 1")
+	}
+	if config.Commands.Step || (config.Command == "redo" && !set["steps"]) {
+		config.Commands.Steps = 1
+	}
+	if config.Commands.Debug {
+		config.LogLevel = slog.LevelDebug
+	}
+
+	return nil
+}
+
+// parseInterspersed parses flags that may appear between the positional
+// arguments and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func globalFlagNames() map[string]bool {
+	fs := flag.NewFlagSet("global", flag.ContinueOnError)
+	globalFlags(fs, &Config{})
+
+	names := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) { names[f.Name] = true })
+	return names
+}
+
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func usage() {
+	w := os.Stderr
+	fmt.Fprintln(w, "Usage: migrate [global flags] <command> [command flags] [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-15s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintln(w, "\nRun 'migrate <command> -h' for the flags of a command.")
+
+	fmt.Fprintln(w, "\nGlobal flags (defaults are taken from the environment variables in the README):")
+	globals := flag.NewFlagSet("global", flag.ContinueOnError)
+	globalFlags(globals, &Config{Concurrency: 4, LogKeep: 1000, Format: "text", LogFormat: "text", OutOfOrder: "warn", Protection: "none"})
+	globals.SetOutput(w)
+	globals.PrintDefaults()
+
+	fmt.Fprintf(w, "\nDeprecated command flags: -%s\n", strings.Join(legacyCommands, ", -"))
+}
+
+func commandUsage(c command) {
+	w := os.Stderr
+	fmt.Fprintf(w, "Usage: %s\n\n%s.\n", strings.TrimSpace("migrate "+c.Name+" [flags] "+c.Args), c.Summary)
+	if c.Flags != nil {
+		fmt.Fprintln(w, "\nFlags:")
+		fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+		c.Flags(fs, &Commands{Missing: "error"})
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+	}
+	fmt.Fprintln(w, "\nGlobal flags are accepted as well, see 'migrate -h'.")
+}
+
+// Structured reports whether the result is printed as JSON or YAML rather
+// than text.
+func (c Config) Structured() bool {
+	return c.Format == "json" || c.Format == "yaml"
+}
+
+// In returns the reader for answers to confirmation prompts.
+func (c Config) In() io.Reader {
+	if c.Input != nil {
+		return c.Input
+	}
+	return os.Stdin
+}
+
+// LogTable returns the name of the execution log table.
+func (c Config) LogTable() string {
+	return c.TableName + "_log"
+}
+
+// AuditTable returns the name of the audit table.
+func (c Config) AuditTable() string {
+	return c.TableName + "_audit"
+}
+
+// NewLogger returns a logger writing messages of LogLevel and above to w
+// in LogFormat.
+func (c Config) NewLogger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: c.LogLevel}
+	if c.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// Logger returns the logger for the command's messages.
+func (c Config) Logger() *slog.Logger {
+	if c.Log != nil {
+		return c.Log
+	}
+	return c.NewLogger(c.Out())
+}
+
+// Out returns the writer for the command's messages.
+func (c Config) Out() io.Writer {
+	if c.Output != nil {
+		return c.Output
+	}
+	return os.Stdout
+}
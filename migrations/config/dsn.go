@@ -0,0 +1,39 @@
+package config
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// keyValuePassword matches the password of a key=value connection string,
+// plain or single-quoted with backslash escapes.
+var keyValuePassword = regexp.MustCompile(`password=('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactedDSN returns DSN with the password of URL, key=value and MySQL
+// style connection strings hidden, so it can be printed or passed on.
+func (c Config) RedactedDSN() string {
+	if strings.Contains(c.DSN, "://") {
+		if u, err := url.Parse(c.DSN); err == nil {
+			return u.Redacted()
+		}
+	}
+
+	dsn := keyValuePassword.ReplaceAllString(c.DSN, "password=xxxxx")
+
+	// MySQL's user:password@net(addr)/dbname ends the password at the last
+	// @ before the database name, so the password may contain @ itself.
+	prefix := dsn
+	if slash := strings.LastIndex(dsn, "/"); slash >= 0 {
+		prefix = dsn[:slash]
+	}
+	at := strings.LastIndex(prefix, "@")
+	if at < 0 {
+		return dsn
+	}
+	user, _, hasPassword := strings.Cut(dsn[:at], ":")
+	if !hasPassword {
+		return dsn
+	}
+	return user + ":xxxxx" + dsn[at:]
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigFile is read when it exists and no -config is given.
+const DefaultConfigFile = "migrate.yaml"
+
+// File is a configuration file with named environments. Every environment
+// maps global flag names, such as db-host, to their values, which may
+// reference environment variables as ${VAR} or ${VAR:-default}.
+type File struct {
+	Default      string                          `yaml:"default"`
+	Environments map[string]map[string]yaml.Node `yaml:"environments"`
+}
+
+// loadFile applies the settings of the selected environment to config.
+// An explicitly named file must exist; the default one is optional.
+func loadFile(config *Config, path, env string, explicit bool) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		if env != "" {
+			return fmt.Errorf("environment %q selected but %s does not exist", env, path)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+
+	var file File
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	if env == "" {
+		env = file.Default
+	}
+	if env == "" {
+		return fmt.Errorf("%s defines no default environment, select one with -env (available: %s)", path, strings.Join(file.names(), ", "))
+	}
+
+	settings, ok := file.Environments[env]
+	if !ok {
+		return fmt.Errorf("environment %q not found in %s (available: %s)", env, path, strings.Join(file.names(), ", "))
+	}
+
+	fs := flag.NewFlagSet("file", flag.ContinueOnError)
+	globalFlags(fs, config)
+	for key, value := range settings {
+		if key == "config" || key == "env" || fs.Lookup(key) == nil {
+			return fmt.Errorf("unknown setting %q in environment %q of %s", key, env, path)
+		}
+
+		// The value is used as written, so YAML does not turn 00123 into
+		// an octal number or 1e3 into 1000.
+		if value.Kind != yaml.ScalarNode {
+			return fmt.Errorf("setting %q in environment %q of %s must be a single value", key, env, path)
+		}
+		expanded, err := interpolate(value.Value)
+		if err != nil {
+			return fmt.Errorf("setting %q in environment %q: %v", key, env, err)
+		}
+
+		if err := fs.Set(key, expanded); err != nil {
+			return fmt.Errorf("invalid setting %q in environment %q: %v", key, env, err)
+		}
+	}
+
+	config.ConfigFile = path
+	config.Env = env
+	return nil
+}
+
+func (f File) names() []string {
+	names := make([]string, 0, len(f.Environments))
+	for name := range f.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// interpolate replaces ${VAR} and ${VAR:-default} with environment
+// variables and $$ with a literal $. A variable that is not set and has no
+// default is an error.
+func interpolate(value string) (string, error) {
+	var missing []string
+	expanded := os.Expand(value, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+
+		fallback, hasFallback := "", false
+		if i := strings.Index(name, ":-"); i >= 0 {
+			name, fallback, hasFallback = name[:i], name[i+2:], true
+		}
+
+		if v, ok := os.LookupEnv(name); ok && v != "" {
+			return v
+		}
+		if !hasFallback {
+			missing = append(missing, name)
+		}
+		return fallback
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// lookupArg finds the value of a global flag in args before they are
+// parsed, so the config file can be loaded first.
+func lookupArg(args []string, name string) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+
+		trimmed := strings.TrimLeft(arg, "-")
+		if !strings.HasPrefix(arg, "-") || len(arg)-len(trimmed) > 2 {
+			continue
+		}
+
+		if trimmed == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if value, ok := strings.CutPrefix(trimmed, name+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interpreters maps a script extension such as ".py" to the command
+// running scripts with it, e.g. "python3 -u".
+type Interpreters map[string]string
+
+func (i Interpreters) String() string {
+	exts := make([]string, 0, len(i))
+	for ext := range i {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	pairs := make([]string, len(exts))
+	for n, ext := range exts {
+		pairs[n] = ext + "=" + i[ext]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set adds the comma-separated ext=command pairs of value, replacing the
+// interpreters already set for those extensions.
+func (i *Interpreters) Set(value string) error {
+	if *i == nil {
+		*i = make(Interpreters)
+	}
+	for _, pair := range strings.Split(value, ",") {
+		ext, command, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		ext, command = strings.TrimSpace(ext), strings.TrimSpace(command)
+		if !ok || ext == "" || command == "" {
+			return fmt.Errorf("invalid interpreter %q, use ext=command", pair)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		(*i)[ext] = command
+	}
+	return nil
+}
+
+// DefaultScriptEnv are the environment variables migration scripts get from
+// the tool's environment. A trailing * matches any suffix.
+var DefaultScriptEnv = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "TZ", "TMPDIR", "LANG", "LC_*"}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\*?$`)
+
+// ScriptEnv lists names of environment variables, each optionally ending
+// in * to match any suffix.
+type ScriptEnv []string
+
+func (e ScriptEnv) String() string {
+	return strings.Join(e, ",")
+}
+
+// Set adds the comma-separated names of value.
+func (e *ScriptEnv) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+		*e = append(*e, name)
+	}
+	return nil
+}
+
+// Allows reports whether the variable name is in the default list or in e.
+func (e ScriptEnv) Allows(name string) bool {
+	for _, list := range [][]string{DefaultScriptEnv, e} {
+		for _, allowed := range list {
+			if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(name, prefix) || allowed == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ScriptLimits are resource limits of a migration script; zero means no
+// limit.
+type ScriptLimits struct {
+	// CPU is the processor time, Memory the size of the address space in
+	// bytes and Files the number of open files.
+	CPU    time.Duration
+	Memory int64
+	Files  int
+}
+
+// IsZero reports whether no limit is set.
+func (l ScriptLimits) IsZero() bool {
+	return l == ScriptLimits{}
+}
+
+func (l ScriptLimits) String() string {
+	var limits []string
+	if l.CPU > 0 {
+		limits = append(limits, "cpu="+l.CPU.String())
+	}
+	if l.Memory > 0 {
+		limits = append(limits, "memory="+strconv.FormatInt(l.Memory, 10))
+	}
+	if l.Files > 0 {
+		limits = append(limits, "files="+strconv.Itoa(l.Files))
+	}
+	return strings.Join(limits, ",")
+}
+
+// Set parses comma-separated limits: cpu as a duration of at least one
+// second, memory in bytes with an optional K, M or G suffix, and files as
+// a number.
+func (l *ScriptLimits) Set(value string) error {
+	for _, limit := range strings.Split(value, ",") {
+		name, v, ok := strings.Cut(strings.TrimSpace(limit), "=")
+		if !ok {
+			return fmt.Errorf("invalid limit %q, use name=value", limit)
+		}
+
+		switch strings.TrimSpace(name) {
+		case "cpu":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Second {
+				return fmt.Errorf("invalid cpu limit %q, use a duration of at least 1s", v)
+			}
+			l.CPU = d
+		case "memory":
+			n, err := parseSize(v)
+			if err != nil {
+				return fmt.Errorf("invalid memory limit %q, use bytes with an optional K, M or G suffix", v)
+			}
+			l.Memory = n
+		case "files":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid files limit %q", v)
+			}
+			l.Files = n
+		default:
+			return fmt.Errorf("unknown limit %q, use cpu, memory or files", name)
+		}
+	}
+	return nil
+}
+
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
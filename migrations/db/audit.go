@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// prepareAuditTable creates the audit table, holding one entry per change
+// of the history, if it does not exist. Entries are only ever added.
+func prepareAuditTable(ctx context.Context, db *sql.DB, config config.Config) error {
+	var id, occurred string
+	switch config.DBType {
+	case "mysql":
+		id, occurred = "BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY", "DATETIME(3)"
+	case "sqlite":
+		id, occurred = "INTEGER PRIMARY KEY AUTOINCREMENT", "DATETIME"
+	case "postgres":
+		id, occurred = "BIGSERIAL PRIMARY KEY", "TIMESTAMP"
+	default:
+		return fmt.Errorf("unsupported database type: %s", config.DBType)
+	}
+
+	query := fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            id %s,
+            migration VARCHAR(255) NOT NULL,
+            event VARCHAR(32) NOT NULL,
+            direction VARCHAR(8) NOT NULL,
+            outcome VARCHAR(16) NOT NULL,
+            occurred_at %s NOT NULL,
+            duration_ms BIGINT,
+            os_user VARCHAR(255),
+            hostname VARCHAR(255),
+            tool_version VARCHAR(64),
+            command VARCHAR(32),
+            run_id VARCHAR(64),
+            detail TEXT
+        );`, config.AuditTable(), id, occurred)
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("error creating table %s: %v", config.AuditTable(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// credentialConnector resolves the password every time the pool opens a
+// new connection, so short-lived credentials from a password file or
+// helper command are refreshed when a connection is re-established.
+type credentialConnector struct {
+	config config.Config
+	dsn    func(config.Config) string
+}
+
+func openWithCredentials(ctx context.Context, config config.Config, dsn func(config.Config) string) (*sql.DB, error) {
+	var db *sql.DB
+	if config.PasswdFile == "" && config.PasswdCommand == "" {
+		var err error
+		if db, err = sql.Open(driverName(config), dsn(config)); err != nil {
+			return nil, fmt.Errorf("error connecting to the database: %v", err)
+		}
+	} else {
+		db = sql.OpenDB(&credentialConnector{config: config, dsn: dsn})
+	}
+
+	if err := pingWithRetry(ctx, db, config); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (c *credentialConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	passwd, err := resolvePassword(ctx, c.config)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := c.config
+	cfg.Passwd = passwd
+
+	var connector driver.Connector
+	switch cfg.DBType {
+	case "mysql":
+		connector, err = mysql.MySQLDriver{}.OpenConnector(c.dsn(cfg))
+	case "postgres":
+		connector, err = pq.NewConnector(c.dsn(cfg))
+	default:
+		return nil, fmt.Errorf("credential helpers are not supported for database type: %s", cfg.DBType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return connector.Connect(ctx)
+}
+
+func (c *credentialConnector) Driver() driver.Driver {
+	if c.config.DBType == "mysql" {
+		return mysql.MySQLDriver{}
+	}
+	return pq.Driver{}
+}
+
+// resolvePassword returns the output of config.PasswdCommand, the content
+// of config.PasswdFile or config.Passwd, in that order of preference.
+func resolvePassword(ctx context.Context, config config.Config) (string, error) {
+	switch {
+	case config.PasswdCommand != "":
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", config.PasswdCommand)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("error running password command: %v", err)
+		}
+		passwd := strings.TrimRight(string(output), "\r\n")
+		if passwd == "" {
+			return "", errors.New("password command returned an empty password")
+		}
+		return passwd, nil
+	case config.PasswdFile != "":
+		content, err := os.ReadFile(config.PasswdFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading password file: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	default:
+		return config.Passwd, nil
+	}
+}
+
+func driverName(config config.Config) string {
+	if config.DBType == "sqlite" {
+		return "sqlite3"
+	}
+	return config.DBType
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+func TestResolvePassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		config config.Config
+		want   string
+	}{
+		{"flag", config.Config{Passwd: "from-flag"}, "from-flag"},
+		{"file with a trailing newline", config.Config{Passwd: "from-flag", PasswdFile: file}, "from-file"},
+		{"command output", config.Config{PasswdCommand: "printf 'from-command\\r\\n'"}, "from-command"},
+		{"command before file", config.Config{PasswdFile: file, PasswdCommand: "echo from-command"}, "from-command"},
+	}
+
+	for _, c := range cases {
+		got, err := resolvePassword(context.Background(), c.config)
+		if err != nil || got != c.want {
+			t.Errorf("%s: resolvePassword() = %q, %v, want %q", c.name, got, err, c.want)
+		}
+	}
+
+	failing := map[string]config.Config{
+		"empty password": {PasswdCommand: "true"},
+		"failed command": {PasswdCommand: "exit 1"},
+		"missing file":   {PasswdFile: filepath.Join(t.TempDir(), "missing")},
+	}
+	for name, cfg := range failing {
+		if got, err := resolvePassword(context.Background(), cfg); err == nil {
+			t.Errorf("%s: expected an error, got password %q", name, got)
+		}
+	}
+}
+
+func TestCredentialConnectorResolvesPassword(t *testing.T) {
+	cfg := config.Config{DBType: "postgres", PasswdCommand: "exit 1"}
+	connector := &credentialConnector{config: cfg, dsn: postgresDSN}
+	if _, err := connector.Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "password command") {
+		t.Fatalf("Expected the password command to run on connect, got %v", err)
+	}
+
+	cfg = config.Config{DBType: "sqlite", PasswdCommand: "echo secret"}
+	connector = &credentialConnector{config: cfg, dsn: postgresDSN}
+	if _, err := connector.Connect(context.Background()); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatalf("Expected credential helpers to be rejected for sqlite, got %v", err)
+	}
+}
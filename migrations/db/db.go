@@ -1,56 +1,46 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
 	"github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func GetConnection(config config.Config) (*sql.DB, error) {
+const (
+	initialRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 10 * time.Second
+)
+
+func GetConnection(ctx context.Context, config config.Config) (*sql.DB, error) {
+	if config.DSN != "" {
+		return openDSN(ctx, config)
+	}
+
 	switch config.DBType {
 	case "mysql":
-		cfg := mysql.Config{
-			User:                 config.User,
-			Passwd:               config.Passwd,
-			Net:                  "tcp",
-			Addr:                 config.Addr,
-			DBName:               config.DBName,
-			AllowNativePasswords: true,
-		}
-
-		db, err := sql.Open("mysql", cfg.FormatDSN())
-		if err != nil {
-			return nil, fmt.Errorf("error connecting to the database: %v", err)
-		}
-		if err := db.Ping(); err != nil {
-			return nil, fmt.Errorf("error pinging the database: %v", err)
-		}
-		return db, nil
+		return openWithCredentials(ctx, config, mysqlDSN)
 	case "postgres":
-		psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-			config.Addr, config.Port, config.User, config.Passwd, config.DBName, "disable")
-
-		db, err := sql.Open("postgres", psqlInfo)
-		if err != nil {
-			return nil, fmt.Errorf("error connecting to the database: %v", err)
-		}
-		if err := db.Ping(); err != nil {
-			return nil, fmt.Errorf("error pinging the database: %v", err)
-		}
-		return db, nil
+		return openWithCredentials(ctx, config, postgresDSN)
 	case "sqlite":
 		//const dbPath = "./your_database.db" // Replace with the actual path to your database file
 		db, err := sql.Open("sqlite3", config.DBType)
 		if err != nil {
 			panic(err)
 		}
-		if err := db.Ping(); err != nil {
-			return nil, fmt.Errorf("error pinging the database: %v", err)
+		if err := pingWithRetry(ctx, db, config); err != nil {
+			db.Close()
+			return nil, err
 		}
 		return db, nil
 	default:
@@ -58,13 +48,145 @@ func GetConnection(config config.Config) (*sql.DB, error) {
 	}
 }
 
+func mysqlDSN(config config.Config) string {
+	cfg := mysql.Config{
+		User:                 config.User,
+		Passwd:               config.Passwd,
+		Net:                  "tcp",
+		Addr:                 config.Addr,
+		DBName:               config.DBName,
+		AllowNativePasswords: true,
+	}
+	return cfg.FormatDSN()
+}
+
+func postgresDSN(config config.Config) string {
+	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		config.Addr, config.Port, config.User, quoteValue(config.Passwd), config.DBName, "disable")
+	if config.Schema != "" {
+		psqlInfo += " search_path=" + searchPath(config.Schema)
+	}
+	return psqlInfo
+}
+
+// openDSN connects using config.DSN, a connection string in the native
+// format of the driver selected by config.DBType.
+func openDSN(ctx context.Context, config config.Config) (*sql.DB, error) {
+	var driverName string
+	switch config.DBType {
+	case "mysql":
+		driverName = "mysql"
+	case "postgres":
+		driverName = "postgres"
+	case "sqlite":
+		driverName = "sqlite3"
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", config.DBType)
+	}
+
+	dsn := config.DSN
+	if config.DBType == "postgres" && config.Schema != "" {
+		if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+			query := u.Query()
+			query.Set("search_path", `"`+strings.ReplaceAll(config.Schema, `"`, `""`)+`"`)
+			u.RawQuery = query.Encode()
+			dsn = u.String()
+		} else {
+			dsn += " search_path=" + searchPath(config.Schema)
+		}
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the database: %v", err)
+	}
+	if err := pingWithRetry(ctx, db, config); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// searchPath returns a key=value connection string value that sets the
+// Postgres search_path to the single, quoted schema.
+func searchPath(schema string) string {
+	return quoteValue(`"` + strings.ReplaceAll(schema, `"`, `""`) + `"`)
+}
+
+// quoteValue quotes a value of a Postgres key=value connection string.
+func quoteValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// pingWithRetry pings the database until it answers or config.ConnectTimeout
+// elapses, waiting with exponential backoff and jitter between attempts.
+// Errors that cannot go away by waiting, such as bad credentials or an
+// unknown database, are returned immediately.
+func pingWithRetry(ctx context.Context, db *sql.DB, config config.Config) error {
+	deadline := time.Now().Add(config.ConnectTimeout)
+	delay := initialRetryDelay
+
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			if attempt > 1 {
+				config.Logger().Info("Connected to the database", "attempts", attempt)
+			}
+			return nil
+		}
+
+		if ctx.Err() != nil || isPermanentError(err) {
+			return fmt.Errorf("error pinging the database: %v", err)
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+		if config.ConnectTimeout <= 0 || time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("error pinging the database after %d attempt(s): %v", attempt, err)
+		}
+
+		config.Logger().Warn("Database not ready, retrying", "attempt", attempt, "error", err, "wait", wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("error pinging the database: %v", ctx.Err())
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// isPermanentError reports whether err is an authentication or unknown
+// database error, which retrying will not fix.
+func isPermanentError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1044, 1045, 1049: // access denied for database, access denied for user, unknown database
+			return true
+		}
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "28000", "28P01", "3D000": // invalid authorization, invalid password, invalid catalog name
+			return true
+		}
+	}
+
+	return false
+}
+
 func CloseConnection(db *sql.DB) {
 	if err := db.Close(); err != nil {
-		log.Printf("Error closing the database: %v", err)
+		slog.Error("Error closing the database", "error", err)
 	}
 }
 
-func PrepareMigrationTable(db *sql.DB, config config.Config) error {
+func PrepareMigrationTable(ctx context.Context, db *sql.DB, config config.Config) error {
 	var query string
 	switch config.DBType {
 	case "mysql":
@@ -88,7 +210,7 @@ func PrepareMigrationTable(db *sql.DB, config config.Config) error {
         SELECT EXISTS (
             SELECT 1
             FROM   pg_tables
-            WHERE  schemaname = 'public'
+            WHERE  schemaname = current_schema()
             AND    tablename = '%s'
         );`, config.TableName)
 	default:
@@ -96,7 +218,7 @@ func PrepareMigrationTable(db *sql.DB, config config.Config) error {
 	}
 
 	var exists bool
-	if err := db.QueryRow(query).Scan(&exists); err != nil {
+	if err := db.QueryRowContext(ctx, query).Scan(&exists); err != nil {
 		return fmt.Errorf("error executing query: %v", err)
 	}
 
@@ -125,11 +247,59 @@ func PrepareMigrationTable(db *sql.DB, config config.Config) error {
 			return fmt.Errorf("unsupported database type: %s", config.DBType)
 		}
 
-		if _, err := db.Exec(createTableQuery); err != nil {
+		if _, err := db.ExecContext(ctx, createTableQuery); err != nil {
 			return fmt.Errorf("error creating table: %v", err)
 		}
 
-		fmt.Printf("Table %s created successfully\n", config.TableName)
+		config.Logger().Info("Migration table created", "table", config.TableName)
+	}
+
+	if err := addMissingColumns(ctx, db, config); err != nil {
+		return err
+	}
+	if err := prepareLogTable(ctx, db, config); err != nil {
+		return err
+	}
+	return prepareAuditTable(ctx, db, config)
+}
+
+// migrationColumns are the columns added to the migration table after its
+// first version. Tables are created with the original columns and brought
+// up to date by addMissingColumns, which also upgrades existing tables.
+var migrationColumns = []struct {
+	name       string
+	definition string
+}{
+	{"checksum", "VARCHAR(64)"},
+	{"status", "VARCHAR(16)"},
+	{"note", "TEXT"},
+}
+
+func addMissingColumns(ctx context.Context, db *sql.DB, config config.Config) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s LIMIT 0", config.TableName))
+	if err != nil {
+		return fmt.Errorf("error reading columns of %s: %v", config.TableName, err)
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("error reading columns of %s: %v", config.TableName, err)
+	}
+
+	existing := make(map[string]bool)
+	for _, column := range columns {
+		existing[strings.ToLower(column)] = true
+	}
+
+	for _, column := range migrationColumns {
+		if existing[column.name] {
+			continue
+		}
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", config.TableName, column.name, column.definition)
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("error adding column %s: %v", column.name, err)
+		}
 	}
 
 	return nil
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+func TestIsPermanentError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: 1045, Message: "Access denied for user"}, true},
+		{&mysql.MySQLError{Number: 1049, Message: "Unknown database"}, true},
+		{fmt.Errorf("ping: %w", &mysql.MySQLError{Number: 1044}), true},
+		{&mysql.MySQLError{Number: 1040, Message: "Too many connections"}, false},
+		{&pq.Error{Code: "28P01"}, true},
+		{&pq.Error{Code: "3D000"}, true},
+		{&pq.Error{Code: "57P03"}, false}, // the database system is starting up
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, false},
+		{mysql.ErrInvalidConn, false},
+	}
+
+	for _, c := range cases {
+		if got := isPermanentError(c.err); got != c.want {
+			t.Errorf("isPermanentError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestPingWithRetry(t *testing.T) {
+	// Nothing listens on the port of a closed listener, so the ping fails
+	// with a transient error.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	db, err := sql.Open("mysql", "user:secret@tcp("+addr+")/migrations?timeout=1s")
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer db.Close()
+
+	cfg := config.Config{DBType: "mysql", Output: io.Discard}
+	err = pingWithRetry(context.Background(), db, cfg)
+	if err == nil || !strings.Contains(err.Error(), "after 1 attempt(s)") {
+		t.Fatalf("Expected a single attempt without -connect-timeout, got %v", err)
+	}
+
+	cfg.ConnectTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := pingWithRetry(ctx, db, cfg); err == nil {
+		t.Fatal("Expected a cancelled context to stop the retries")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the retries to stop at once, took %s", elapsed)
+	}
+
+	sqlite, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	defer sqlite.Close()
+	if err := pingWithRetry(context.Background(), sqlite, cfg); err != nil {
+		t.Fatalf("Expected a reachable database to answer, got %v", err)
+	}
+}
+
+func TestSearchPath(t *testing.T) {
+	cases := map[string]string{
+		"tenant_1":  `'"tenant_1"'`,
+		"Tenant A":  `'"Tenant A"'`,
+		`a"b`:       `'"a""b"'`,
+		"it's":      `'"it\'s"'`,
+		`back\path`: `'"back\\path"'`,
+	}
+
+	for schema, want := range cases {
+		if got := searchPath(schema); got != want {
+			t.Errorf("searchPath(%q) = %s, want %s", schema, got, want)
+		}
+	}
+}
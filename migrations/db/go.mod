@@ -11,4 +11,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.22
 )
 
-require filippo.io/edwards25519 v1.1.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// prepareLogTable creates the execution log table, holding one entry per
+// migration run with its script output and errors, if it does not exist.
+func prepareLogTable(ctx context.Context, db *sql.DB, config config.Config) error {
+	var id, started, output string
+	switch config.DBType {
+	case "mysql":
+		id, started, output = "BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY", "TIMESTAMP(3) NULL", "MEDIUMTEXT"
+	case "sqlite":
+		id, started, output = "INTEGER PRIMARY KEY AUTOINCREMENT", "DATETIME", "TEXT"
+	case "postgres":
+		id, started, output = "BIGSERIAL PRIMARY KEY", "TIMESTAMP", "TEXT"
+	default:
+		return fmt.Errorf("unsupported database type: %s", config.DBType)
+	}
+
+	query := fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            id %s,
+            migration VARCHAR(255) NOT NULL,
+            run_id VARCHAR(64),
+            direction VARCHAR(8) NOT NULL,
+            status VARCHAR(16) NOT NULL,
+            started_at %s,
+            duration_ms BIGINT,
+            output %s,
+            error TEXT
+        );`, config.LogTable(), id, started, output)
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("error creating table %s: %v", config.LogTable(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// Audit events, one per change of the history.
+const (
+	EventApply         = "apply"
+	EventRevert        = "revert"
+	EventBaseline      = "baseline"
+	EventMarkApplied   = "mark-applied"
+	EventMarkUnapplied = "mark-unapplied"
+	EventPurge         = "purge"
+)
+
+// eventDirections maps the audit events to the direction they change the
+// history in.
+var eventDirections = map[string]string{
+	EventApply:         "up",
+	EventRevert:        "down",
+	EventBaseline:      "up",
+	EventMarkApplied:   "up",
+	EventMarkUnapplied: "down",
+	EventPurge:         "down",
+}
+
+// AuditEvent is an entry of the audit table.
+type AuditEvent struct {
+	Version     string    `json:"version" yaml:"version"`
+	Event       string    `json:"event" yaml:"event"`
+	Direction   string    `json:"direction" yaml:"direction"`
+	Outcome     string    `json:"outcome" yaml:"outcome"`
+	OccurredAt  time.Time `json:"occurred_at" yaml:"occurred_at"`
+	DurationMs  int64     `json:"duration_ms" yaml:"duration_ms"`
+	User        string    `json:"user,omitempty" yaml:"user,omitempty"`
+	Hostname    string    `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	ToolVersion string    `json:"tool_version,omitempty" yaml:"tool_version,omitempty"`
+	Command     string    `json:"command,omitempty" yaml:"command,omitempty"`
+	RunID       string    `json:"run_id,omitempty" yaml:"run_id,omitempty"`
+	Detail      string    `json:"detail,omitempty" yaml:"detail,omitempty"`
+}
+
+// recordAudit adds the change of the history described by entry, started
+// at start, to the audit table, with the error or note of entry as its
+// detail. Like saveExecutionLog it runs even after cancellation and only
+// warns when it fails.
+func recordAudit(ctx context.Context, db *sql.DB, config config.Config, event string, start time.Time, entry MigrationReport) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), bookkeepingTimeout)
+	defer cancel()
+
+	var duration int64
+	if entry.DurationMs != nil {
+		duration = *entry.DurationMs
+	}
+	detail := entry.Error
+	if detail == "" {
+		detail = entry.Note
+	}
+	hostname, _ := os.Hostname()
+
+	query := rebind(config, fmt.Sprintf("INSERT INTO %s (migration, event, direction, outcome, occurred_at, duration_ms, os_user, hostname, tool_version, command, run_id, detail) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", config.AuditTable()))
+	_, err := db.ExecContext(ctx, query, entry.Version, event, eventDirections[event], entry.State, auditTime(config, start), duration,
+		nullString(osUser()), nullString(hostname), nullString(config.ToolVersion), nullString(config.Command), nullString(config.RunID), nullString(detail))
+	if err != nil {
+		config.Logger().Warn("Error writing the audit table", "error", err)
+	}
+}
+
+// failedEntry returns entry as failed with err, for the audit table.
+func failedEntry(entry MigrationReport, err error) MigrationReport {
+	entry.State, entry.AppliedAt, entry.Error = StateFailed, nil, err.Error()
+	return entry
+}
+
+// osUser returns the name of the user running the tool, falling back to
+// the environment where the user database cannot be read.
+func osUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// auditTime converts t to the value stored in occurred_at. Times are
+// stored in UTC, and as text for SQLite, so that they compare in order.
+func auditTime(config config.Config, t time.Time) interface{} {
+	if config.DBType == "sqlite" {
+		return t.UTC().Format("2006-01-02 15:04:05.000")
+	}
+	return t.UTC()
+}
+
+// LoadAuditEvents returns the audit entries, oldest first, of the
+// migration version, or of all migrations when version is empty, that
+// occurred at or after since and before until; zero times do not limit.
+func LoadAuditEvents(ctx context.Context, db *sql.DB, config config.Config, version string, since, until time.Time) ([]AuditEvent, error) {
+	where, args := "1 = 1", []interface{}{}
+	if version != "" {
+		where, args = where+" AND migration = ?", append(args, version)
+	}
+	if !since.IsZero() {
+		where, args = where+" AND occurred_at >= ?", append(args, auditTime(config, since))
+	}
+	if !until.IsZero() {
+		where, args = where+" AND occurred_at < ?", append(args, auditTime(config, until))
+	}
+	query := rebind(config, fmt.Sprintf("SELECT migration, event, direction, outcome, occurred_at, duration_ms, os_user, hostname, tool_version, command, run_id, detail FROM %s WHERE %s ORDER BY id ASC", config.AuditTable(), where))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying the audit table: %v", err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		var occurredAt string
+		var duration sql.NullInt64
+		var userName, hostname, toolVersion, command, runID, detail sql.NullString
+		if err := rows.Scan(&e.Version, &e.Event, &e.Direction, &e.Outcome, &occurredAt, &duration, &userName, &hostname, &toolVersion, &command, &runID, &detail); err != nil {
+			return nil, fmt.Errorf("error scanning audit row: %v", err)
+		}
+		e.DurationMs, e.User, e.Hostname, e.ToolVersion = duration.Int64, userName.String, hostname.String, toolVersion.String
+		e.Command, e.RunID, e.Detail = command.String, runID.String, detail.String
+
+		if e.OccurredAt, err = parseTimestamp(config, occurredAt); err != nil {
+			return nil, fmt.Errorf("error parsing occurred_at timestamp: %v", err)
+		}
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over audit rows: %v", err)
+	}
+	return events, nil
+}
+
+// handleAuditCommand lists the audit entries, optionally of the migration
+// config.Commands.Version only and within -since and -until.
+func handleAuditCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	events, err := LoadAuditEvents(ctx, db, config, config.Commands.Version, config.Commands.Since, config.Commands.Until)
+	if err != nil {
+		return err
+	}
+
+	report.Events = append([]AuditEvent{}, events...)
+	for _, e := range events {
+		report.Summary[e.Event]++
+	}
+	if config.Structured() {
+		return nil
+	}
+
+	if len(events) == 0 {
+		fmt.Fprintln(config.Out(), "No entries in the audit table.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(config.Out(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tVERSION\tEVENT\tOUTCOME\tDURATION\tUSER\tHOST\tTOOL\tDETAIL")
+	for _, e := range events {
+		detail, _, _ := strings.Cut(e.Detail, "\n")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%dms\t%s\t%s\t%s\t%s\n", e.OccurredAt.Local().Format("2006-01-02 15:04:05"), e.Version, e.Event, e.Outcome,
+			e.DurationMs, dash(e.User), dash(e.Hostname), dash(e.ToolVersion), detail)
+	}
+	return tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// handleBaselineCommand records every migration up to and including
+// config.Commands.Version as applied without running it, for databases
+// whose schema already matches that version. An existing history is only
+// added to with -force; migrations already in it are left as they are.
+func handleBaselineCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	version := config.Commands.Version
+
+	release, err := acquireLock(ctx, db, config)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	onDisk, err := listMigrations(config)
+	if err != nil {
+		return err
+	}
+	if !contains(onDisk, version) {
+		return fmt.Errorf("migration %s not found in %s", version, config.Path)
+	}
+
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
+	if err != nil {
+		return err
+	}
+	if len(historyMigrations) > 0 && !config.Commands.Force {
+		return fmt.Errorf("the migration table already has %d entries, use -force to baseline anyway", len(historyMigrations))
+	}
+
+	applied := make(map[string]bool)
+	for _, m := range historyMigrations {
+		applied[m.Migration] = true
+	}
+
+	now := time.Now()
+	var records []Migration
+	for _, migration := range onDisk {
+		if migration > version {
+			break
+		}
+		if !applied[migration] {
+			records = append(records, Migration{Migration: migration, AppliedAt: now, Status: RecordBaselined})
+		}
+	}
+
+	if config.Commands.Force {
+		var plan []string
+		for _, m := range records {
+			plan = append(plan, strings.TrimSpace(m.Migration+"  "+loadDescription(config, m.Migration)))
+		}
+		if err := confirmPlan(config, "baseline", plan); err != nil {
+			return err
+		}
+	}
+
+	err = recordMigrations(ctx, db, config, records)
+	for _, m := range records {
+		entry := MigrationReport{
+			Version:     m.Migration,
+			State:       StateApplied,
+			AppliedAt:   appliedAt(m.AppliedAt),
+			Description: loadDescription(config, m.Migration),
+			Recorded:    m.Status,
+		}
+		audit := entry
+		if config.Commands.Force {
+			audit.Note = "forced with -force"
+		}
+		if err != nil {
+			audit = failedEntry(audit, err)
+		}
+		recordAudit(ctx, db, config, EventBaseline, now, audit)
+		if err != nil {
+			continue
+		}
+
+		report.add(entry)
+		config.Logger().Info("Migration recorded as baselined", "migration", m.Migration, "direction", "up")
+	}
+	if err != nil {
+		return err
+	}
+	config.Logger().Info("Baseline done", "version", version, "count", len(records))
+	return nil
+}
+
+// recordMigrations adds records to the history in a single transaction.
+func recordMigrations(ctx context.Context, db *sql.DB, config config.Config, records []Migration) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				err = fmt.Errorf("%v (rollback failed: %v)", err, rbErr)
+			}
+			return
+		}
+		if commitErr := tx.Commit(); commitErr != nil {
+			err = fmt.Errorf("error committing transaction: %v", commitErr)
+		}
+	}()
+
+	for _, m := range records {
+		if err = RecordMigration(ctx, tx, config, m); err != nil {
+			return fmt.Errorf("error adding migration: %v %v", m.Migration, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+	"golang.org/x/term"
+)
+
+// Confirms reports whether the command asks for confirmation before it
+// changes anything, unless -yes is given.
+func Confirms(config config.Config) bool {
+	if config.Commands.DryRun {
+		return false
+	}
+	switch config.Command {
+	case "down", "redo", "mark-applied", "mark-unapplied":
+		return true
+	case "baseline":
+		return config.Commands.Force
+	default:
+		return false
+	}
+}
+
+// Protected reports whether the command is a down or redo on an environment
+// with protection confirm or deny.
+func Protected(config config.Config) bool {
+	return (config.Command == "down" || config.Command == "redo") &&
+		(config.Protection == "confirm" || config.Protection == "deny")
+}
+
+// confirmPlan shows what the command is about to do and asks whether to go
+// on. Down and redo on a protected environment are refused with protection
+// deny, and with confirm need the environment name typed or given with
+// -confirm instead of a yes.
+func confirmPlan(config config.Config, action string, plan []string) error {
+	if len(plan) == 0 {
+		return nil
+	}
+
+	protected := Protected(config)
+	name := protectedName(config)
+
+	switch {
+	case protected && config.Protection == "deny":
+		return fmt.Errorf("%s is not allowed on %s, it is protected", config.Command, describeTarget(config))
+	case protected && name == "":
+		return errors.New("a protected environment needs -env or -db-name to confirm against")
+	case protected && config.Commands.Confirm != "":
+		if config.Commands.Confirm != name {
+			return fmt.Errorf("-confirm %q does not match %q, nothing was changed", config.Commands.Confirm, name)
+		}
+		return nil
+	case !protected && config.Commands.Yes:
+		return nil
+	}
+
+	fmt.Fprintf(config.Out(), "About to %s %d migration(s) on %s:\n", action, len(plan), describeTarget(config))
+	for _, line := range plan {
+		fmt.Fprintf(config.Out(), "  %s\n", line)
+	}
+
+	if !protected {
+		return confirm(config, "Continue?")
+	}
+
+	answer, err := ask(config, fmt.Sprintf("%s is protected. Type %q to continue:", describeTarget(config), name), "-confirm "+name)
+	if err != nil {
+		return err
+	}
+	if answer != name {
+		return errors.New("not confirmed, nothing was changed")
+	}
+	return nil
+}
+
+// confirm asks question and returns an error unless it is answered with
+// y or yes. It does not ask when -yes was given.
+func confirm(config config.Config, question string) error {
+	if config.Commands.Yes {
+		return nil
+	}
+
+	answer, err := ask(config, question+" [y/N]", "-yes")
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return nil
+	default:
+		return errors.New("not confirmed, nothing was changed")
+	}
+}
+
+// ask prints question and reads a line from config.In(). Standard input
+// must be a terminal, so a script never confirms by accident; flag names
+// the option to use instead.
+func ask(config config.Config, question, flag string) (string, error) {
+	if config.Input == nil && !isTerminal(os.Stdin) {
+		return "", fmt.Errorf("confirmation needed but standard input is not a terminal, use %s", flag)
+	}
+
+	fmt.Fprintf(config.Out(), "%s ", question)
+	answer, err := bufio.NewReader(config.In()).ReadString('\n')
+	if errors.Is(err, io.EOF) && answer == "" {
+		fmt.Fprintln(config.Out())
+		return "", fmt.Errorf("no answer to the confirmation, use %s", flag)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("error reading the answer: %v", err)
+	}
+
+	return strings.TrimSpace(answer), nil
+}
+
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// protectedName is the name to type to confirm a command on a protected
+// environment.
+func protectedName(config config.Config) string {
+	switch {
+	case config.Env != "":
+		return config.Env
+	case config.Schema != "":
+		return config.Schema
+	default:
+		return config.DBName
+	}
+}
+
+func describeTarget(config config.Config) string {
+	switch {
+	case config.Env != "":
+		return "environment " + config.Env
+	case config.Schema != "":
+		return "schema " + config.Schema
+	case config.DBName != "":
+		return "database " + config.DBName
+	default:
+		return "the database"
+	}
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// maxLogOutput caps the output stored per execution log entry; the end of
+// longer output is kept.
+const maxLogOutput = 64 << 10
+
+// executionLog collects what happens while a migration runs: the output
+// of its scripts and the outcome and time of every step.
+type executionLog struct {
+	mu        sync.Mutex
+	output    []byte
+	truncated bool
+}
+
+// Write adds script output, keeping the last maxLogOutput bytes.
+func (l *executionLog) Write(p []byte) (int, error) {
+	if l == nil {
+		return len(p), nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.output = append(l.output, p...)
+	if len(l.output) > maxLogOutput {
+		l.output = append([]byte(nil), l.output[len(l.output)-maxLogOutput:]...)
+		l.truncated = true
+	}
+	return len(p), nil
+}
+
+// step records the outcome of a step of the migration started at start.
+func (l *executionLog) step(name string, start time.Time, err error) {
+	duration := time.Since(start).Milliseconds()
+	if err != nil {
+		fmt.Fprintf(l, "-- %s failed after %dms: %v\n", name, duration, err)
+		return
+	}
+	fmt.Fprintf(l, "-- %s done in %dms\n", name, duration)
+}
+
+func (l *executionLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.truncated {
+		return "[earlier output truncated]\n" + string(l.output)
+	}
+	return string(l.output)
+}
+
+// saveExecutionLog stores the run of a migration described by entry in the
+// execution log table and removes the entries beyond config.LogKeep. It
+// runs even after cancellation, and only warns when it fails, as the
+// migration itself is done.
+func saveExecutionLog(ctx context.Context, db *sql.DB, config config.Config, l *executionLog, direction string, start time.Time, entry MigrationReport) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), bookkeepingTimeout)
+	defer cancel()
+
+	var duration int64
+	if entry.DurationMs != nil {
+		duration = *entry.DurationMs
+	}
+
+	query := rebind(config, fmt.Sprintf("INSERT INTO %s (migration, run_id, direction, status, started_at, duration_ms, output, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", config.LogTable()))
+	_, err := db.ExecContext(ctx, query, entry.Version, nullString(config.RunID), direction, entry.State, start, duration, nullString(l.String()), nullString(entry.Error))
+	if err == nil && config.LogKeep > 0 {
+		// MySQL cannot select from the table a DELETE changes, hence the
+		// derived table.
+		query = rebind(config, fmt.Sprintf("DELETE FROM %[1]s WHERE id <= (SELECT last FROM (SELECT MAX(id) - ? AS last FROM %[1]s) AS newest)", config.LogTable()))
+		_, err = db.ExecContext(ctx, query, config.LogKeep)
+	}
+	if err != nil {
+		config.Logger().Warn("Error writing the execution log", "error", err)
+	}
+}
+
+// Execution is an entry of the execution log table.
+type Execution struct {
+	Migration  string
+	RunID      string
+	Direction  string
+	Status     string
+	StartedAt  time.Time
+	DurationMs int64
+	Output     string
+	Error      string
+}
+
+// LoadExecutions returns the execution log entries of the migration,
+// newest first.
+func LoadExecutions(ctx context.Context, db *sql.DB, config config.Config, migration string) ([]Execution, error) {
+	query := rebind(config, fmt.Sprintf("SELECT migration, run_id, direction, status, started_at, duration_ms, output, error FROM %s WHERE migration = ? ORDER BY id DESC", config.LogTable()))
+
+	rows, err := db.QueryContext(ctx, query, migration)
+	if err != nil {
+		return nil, fmt.Errorf("error querying the execution log: %v", err)
+	}
+	defer rows.Close()
+
+	var executions []Execution
+	for rows.Next() {
+		var e Execution
+		var startedAt string
+		var runID, output, errText sql.NullString
+		var duration sql.NullInt64
+		if err := rows.Scan(&e.Migration, &runID, &e.Direction, &e.Status, &startedAt, &duration, &output, &errText); err != nil {
+			return nil, fmt.Errorf("error scanning execution log row: %v", err)
+		}
+		e.RunID, e.Output, e.Error, e.DurationMs = runID.String, output.String, errText.String, duration.Int64
+
+		if e.StartedAt, err = parseTimestamp(config, startedAt); err != nil {
+			return nil, fmt.Errorf("error parsing started_at timestamp: %v", err)
+		}
+		executions = append(executions, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over execution log rows: %v", err)
+	}
+	return executions, nil
+}
+
+// handleRunsCommand lists the execution log entries of the migration
+// config.Commands.Version, newest first, with their output.
+func handleRunsCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	version := config.Commands.Version
+	executions, err := LoadExecutions(ctx, db, config, version)
+	if err != nil {
+		return err
+	}
+	record, err := findHistoryMigration(ctx, db, config, version)
+	if err != nil {
+		return err
+	}
+	if len(executions) == 0 && record == nil {
+		return fmt.Errorf("migration %s has not been run", version)
+	}
+
+	entry := MigrationReport{Version: version, State: StatePending, Description: loadDescription(config, version), Runs: []RunReport{}}
+	if record != nil {
+		entry.State, entry.AppliedAt, entry.Recorded, entry.Note = StateApplied, appliedAt(record.AppliedAt), record.Status, record.Note
+	}
+	for _, e := range executions {
+		entry.Runs = append(entry.Runs, RunReport{RunID: e.RunID, Direction: e.Direction, State: e.Status, StartedAt: e.StartedAt, DurationMs: e.DurationMs, Output: e.Output, Error: e.Error})
+	}
+	report.add(entry)
+	if config.Structured() {
+		return nil
+	}
+
+	fmt.Fprintf(config.Out(), "Runs of migration %s (%s):\n", version, entry.State)
+	for _, run := range entry.Runs {
+		fmt.Fprintf(config.Out(), "\n%s %s: %s in %dms, run %s\n", run.StartedAt.Format("2006-01-02 15:04:05"), run.Direction, run.State, run.DurationMs, run.RunID)
+		if run.Error != "" {
+			fmt.Fprintf(config.Out(), "Error: %s\n", run.Error)
+		}
+		if run.Output != "" {
+			fmt.Fprint(config.Out(), run.Output)
+		}
+	}
+	if len(entry.Runs) == 0 {
+		fmt.Fprintln(config.Out(), "No runs in the execution log, the migration was recorded without running it or its entries were removed.")
+	}
+	return nil
+}
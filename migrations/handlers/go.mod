@@ -5,3 +5,10 @@ go 1.22.4
 replace github.com/Karol7Krawczyk/golang-migrate/migrations/config => ../config
 
 require github.com/Karol7Krawczyk/golang-migrate/migrations/config v0.0.0-00010101000000-000000000000
+
+require (
+	golang.org/x/term v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.21.0 // indirect
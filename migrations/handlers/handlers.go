@@ -1,11 +1,11 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -14,199 +14,546 @@ import (
 	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
 )
 
+// bookkeepingTimeout limits the writes to the migration table that follow
+// a committed migration. They run even after the command was cancelled, so
+// the table never disagrees with the schema.
+const bookkeepingTimeout = 10 * time.Second
+
+const scriptWaitDelay = 2 * time.Second
+
 type Migration struct {
 	Migration string
 	AppliedAt time.Time
+	Checksum  string
+	// Status tells how the migration was recorded: empty when it was run,
+	// otherwise e.g. RecordManual. Note is the reason given for it.
+	Status string
+	Note   string
 }
 
-func HandleCommand(db *sql.DB, config config.Config) {
-	switch {
-	case config.Commands.History:
-		handleHistoryCommand(db, config)
-	case config.Commands.New:
-		handleNewCommand(db, config)
-	case config.Commands.Up:
-		handleUpCommand(db, config)
-	case config.Commands.Down:
-		handleDownCommand(db, config)
-	case config.Commands.Status != "":
-		handleStatusCommand(db, config)
-	case config.Commands.Create:
-		handleCreateCommand(config)
+// Statuses of history entries that were recorded without running the
+// migration.
+const (
+	RecordManual    = "manual"
+	RecordBaselined = "baselined"
+)
+
+// Statuses of history entries of migrations whose pre-up script skipped
+// them, recorded as applied without running the SQL, or deferred them to
+// a later run, recorded but still pending.
+const (
+	RecordSkipped  = "skipped"
+	RecordDeferred = "deferred"
+)
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// HandleCommand runs config.Command, logging its progress to config.Logger().
+func HandleCommand(ctx context.Context, db *sql.DB, config config.Config) error {
+	_, err := RunCommand(ctx, db, config)
+	return err
+}
+
+// RunCommand runs config.Command and returns its result. With the text
+// output format the result is also printed to config.Out() as the command
+// runs; progress is logged to config.Logger() in any format.
+func RunCommand(ctx context.Context, db *sql.DB, config config.Config) (*Report, error) {
+	if config.RunID == "" {
+		config.RunID = NewRunID()
+	}
+	report := NewReport(config.Command)
+	report.RunID = config.RunID
+	start := time.Now()
+
+	var err error
+	switch config.Command {
+	case "history":
+		err = handleHistoryCommand(ctx, db, config, report)
+	case "new":
+		err = handleNewCommand(ctx, db, config, report)
+	case "up":
+		err = handleUpCommand(ctx, db, config, report)
+	case "down":
+		err = handleDownCommand(ctx, db, config, report)
+	case "redo":
+		err = handleRedoCommand(ctx, db, config, report)
+	case "baseline":
+		err = handleBaselineCommand(ctx, db, config, report)
+	case "mark-applied":
+		err = handleMarkAppliedCommand(ctx, db, config, report)
+	case "mark-unapplied":
+		err = handleMarkUnappliedCommand(ctx, db, config, report)
+	case "status":
+		err = handleStatusCommand(ctx, db, config, report)
+	case "audit":
+		err = handleAuditCommand(ctx, db, config, report)
+	case "create":
+		err = handleCreateCommand(config, report)
 	default:
-		log.Fatalf("No valid command specified")
+		err = fmt.Errorf("no valid command specified")
 	}
+
+	report.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report, err
 }
 
-func handleCreateCommand(config config.Config) {
+func handleCreateCommand(config config.Config, report *Report) error {
 	timestamp := time.Now().Format("20060102150405")
 	migrationName := string(timestamp)
 	description := strings.ReplaceAll(config.Commands.Desc, " ", "_")
 	migrationDir := filepath.Join(config.Path, migrationName)
 
 	if err := os.Mkdir(migrationDir, 0755); err != nil {
-		log.Fatalf("Error creating migration directory: %v", err)
+		return fmt.Errorf("error creating migration directory: %v", err)
 	}
 
 	if err := os.WriteFile(filepath.Join(migrationDir, "up.sql"), []byte("-- Write your 'up' SQL here\n"), 0644); err != nil {
-		log.Fatalf("Error creating 'up' migration file: %v", err)
+		return fmt.Errorf("error creating 'up' migration file: %v", err)
 	}
 
 	if err := os.WriteFile(filepath.Join(migrationDir, "down.sql"), []byte("-- Write your 'down' SQL here\n"), 0644); err != nil {
-		log.Fatalf("Error creating 'down' migration file: %v", err)
+		return fmt.Errorf("error creating 'down' migration file: %v", err)
 	}
 
 	if config.Commands.Script {
-		if err := os.WriteFile(filepath.Join(migrationDir, "up.sh"), []byte("echo 'Migration: "+migrationName+", bash script up'\n"), 0755); err != nil {
-			log.Fatalf("Error creating script up.sh migration: %v", err)
+		if err := os.WriteFile(filepath.Join(migrationDir, "up.sh"), []byte("#!/usr/bin/env bash\necho 'Migration: "+migrationName+", bash script up'\n"), 0755); err != nil {
+			return fmt.Errorf("error creating script up.sh migration: %v", err)
 		}
 
-		if err := os.WriteFile(filepath.Join(migrationDir, "down.sh"), []byte("echo 'Migration: "+migrationName+", bash script down'\n"), 0755); err != nil {
-			log.Fatalf("Error creating script down.sh migration: %v", err)
+		if err := os.WriteFile(filepath.Join(migrationDir, "down.sh"), []byte("#!/usr/bin/env bash\necho 'Migration: "+migrationName+", bash script down'\n"), 0755); err != nil {
+			return fmt.Errorf("error creating script down.sh migration: %v", err)
 		}
 	}
 
 	if description != "" {
 		if err := os.WriteFile(filepath.Join(migrationDir, description+".txt"), []byte("## "+config.Commands.Desc+"\n"), 0644); err != nil {
-			log.Fatalf("Error creating description migration file: %v", err)
+			return fmt.Errorf("error creating description migration file: %v", err)
 		}
 	}
 
-	fmt.Printf("Successfully created new migration: %s\n", migrationName)
+	report.add(MigrationReport{Version: migrationName, State: StateCreated, Description: config.Commands.Desc})
+	config.Logger().Info("Migration created", "migration", migrationName)
+	return nil
 }
 
-func handleStatusCommand(db *sql.DB, config config.Config) {
-	migration := config.Commands.Status
-	historyMigrations, err := LoadHistoryMigrations(db, config)
+func handleHistoryCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	if config.Commands.Version != "" {
+		return handleRunsCommand(ctx, db, config, report)
+	}
+
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
 	if err != nil {
-		log.Fatalf("Error querying migrations: %v", err)
+		return err
 	}
+	deferred, err := LoadDeferredMigrations(ctx, db, config)
+	if err != nil {
+		return err
+	}
+	historyMigrations = append(historyMigrations, deferred...)
+	sort.Slice(historyMigrations, func(i, j int) bool { return historyMigrations[i].Migration < historyMigrations[j].Migration })
 
 	for _, m := range historyMigrations {
-		if m.Migration == migration {
-			fmt.Printf("Migration: %s, Applied At: %s\n", m.Migration, m.AppliedAt)
-			return
+		entry := MigrationReport{
+			Version:     m.Migration,
+			State:       StateApplied,
+			AppliedAt:   appliedAt(m.AppliedAt),
+			Description: loadDescription(config, m.Migration),
+			Recorded:    m.Status,
+			Note:        m.Note,
+		}
+		if m.Status == RecordDeferred {
+			entry.State, entry.AppliedAt = StateDeferred, nil
+		}
+		report.add(entry)
+	}
+	if config.Structured() {
+		return nil
+	}
+
+	fmt.Fprintln(config.Out(), "History of Migrations:")
+	for _, m := range historyMigrations {
+		if m.Status == RecordDeferred {
+			fmt.Fprintf(config.Out(), "Migration: %s, Deferred At: %s", m.Migration, m.AppliedAt)
+		} else {
+			fmt.Fprintf(config.Out(), "Migration: %s, Applied At: %s", m.Migration, m.AppliedAt)
 		}
+		if m.Status != "" {
+			fmt.Fprintf(config.Out(), ", Recorded: %s", m.Status)
+		}
+		if m.Note != "" {
+			fmt.Fprintf(config.Out(), ", Note: %s", m.Note)
+		}
+		fmt.Fprintln(config.Out())
+	}
+
+	if len(historyMigrations) == 0 {
+		fmt.Fprintln(config.Out(), "Migrations not added yet! You can check if there are new migrations")
+		return handleNewCommand(ctx, db, config, NewReport("new"))
 	}
 
-	fmt.Printf("Migration %s not found in history\n", migration)
+	return nil
 }
 
-func handleHistoryCommand(db *sql.DB, config config.Config) {
-	historyMigrations, err := LoadHistoryMigrations(db, config)
+func handleNewCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
 	if err != nil {
-		log.Fatalf("Error querying migrations: %v", err)
+		return fmt.Errorf("error loading migration history: %v", err)
 	}
 
-	fmt.Println("History of Migrations:")
-	for _, m := range historyMigrations {
-		fmt.Printf("Migration: %s, Applied At: %s\n", m.Migration, m.AppliedAt)
+	newMigrations, err := unappliedMigrations(config, historyMigrations)
+	if err != nil {
+		return err
 	}
 
-	if len(historyMigrations) == 0 {
-		fmt.Println("Migrations not added yet! You can check if there are new migrations")
-		handleNewCommand(db, config)
+	deferred, err := LoadDeferredMigrations(ctx, db, config)
+	if err != nil {
+		return fmt.Errorf("error loading migration history: %v", err)
+	}
+	older, _ := outOfOrder(historyMigrations, newMigrations)
+	deferredNotes := make(map[string]string)
+	for _, m := range deferred {
+		deferredNotes[m.Migration] = m.Note
+		delete(older, m.Migration)
 	}
-}
 
-func handleNewCommand(db *sql.DB, config config.Config) {
-	fmt.Println("New migrations to add:")
-	newMigrations := loadNewMigrations(db, config)
+	for _, migration := range newMigrations {
+		entry := MigrationReport{Version: migration, State: StatePending, Description: loadDescription(config, migration), OutOfOrder: older[migration]}
+		if note, ok := deferredNotes[migration]; ok {
+			entry.Recorded, entry.Note = RecordDeferred, note
+		}
+		report.add(entry)
+	}
+	if config.Structured() {
+		return nil
+	}
 
+	fmt.Fprintln(config.Out(), "New migrations to add:")
 	for _, migration := range newMigrations {
-		fmt.Printf("Migration: %s, will be added\n", migration)
+		if note, ok := deferredNotes[migration]; ok {
+			fmt.Fprintf(config.Out(), "Migration: %s, deferred by its script, will be tried again", migration)
+			if note != "" {
+				fmt.Fprintf(config.Out(), ": %s", note)
+			}
+			fmt.Fprintln(config.Out())
+			continue
+		}
+		if older[migration] {
+			fmt.Fprintf(config.Out(), "Migration: %s, will be added out of order\n", migration)
+			continue
+		}
+		fmt.Fprintf(config.Out(), "Migration: %s, will be added\n", migration)
 	}
 
 	if len(newMigrations) == 0 {
-		fmt.Println("There is nothing to add!")
+		fmt.Fprintln(config.Out(), "There is nothing to add!")
 	}
+
+	return nil
 }
 
-func handleUpCommand(db *sql.DB, config config.Config) {
-	fmt.Println("Migrations to add:")
-	newMigrations := loadNewMigrations(db, config)
+func handleUpCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	if !config.Commands.DryRun {
+		release, err := acquireLock(ctx, db, config)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
 
-	for _, migration := range newMigrations {
-		if config.Commands.Steps > 0 || config.Commands.Steps < 0 {
-			content := loadContent(filepath.Join(config.Path, migration, "up.sql"))
-
-			scriptPath := filepath.Join(config.Path, migration, "up.sh")
-			_, err := os.Stat(scriptPath)
-			if !os.IsNotExist(err) {
-				scriptPath := filepath.Join(config.Path, migration, "up.sh")
-				if err := runBashScript(scriptPath, config); err != nil {
-					log.Fatalf("Failed to run pre-migration script: %v", err)
-				}
-			}
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
+	if err != nil {
+		return fmt.Errorf("error loading migration history: %v", err)
+	}
 
-			err = RunQueriesInTransaction(db, SplitSQLQueries(content))
-			if err != nil {
-				log.Fatalf("Error applying migration: %v %v", migration, err)
-			}
+	newMigrations, err := unappliedMigrations(config, historyMigrations)
+	if err != nil {
+		return err
+	}
 
-			if config.Commands.Debug {
-				fmt.Printf("-- DEBUG SQL: %s", content)
-			}
+	deferred, err := LoadDeferredMigrations(ctx, db, config)
+	if err != nil {
+		return fmt.Errorf("error loading migration history: %v", err)
+	}
+
+	// Deferred migrations were pending before, their order is known.
+	older, latest := outOfOrder(historyMigrations, newMigrations)
+	for _, m := range deferred {
+		delete(older, m.Migration)
+	}
+	if err := checkOrder(config, newMigrations, older, latest); err != nil {
+		return err
+	}
 
-			err = AddMigration(db, config, migration)
-			if err != nil {
-				log.Fatalf("Error adding migration:%v %v", migration, err)
-				println(content)
+	plan := newMigrations
+	if config.Commands.Steps >= 0 && config.Commands.Steps < len(plan) {
+		plan = plan[:config.Commands.Steps]
+	}
+
+	if config.Commands.DryRun {
+		return handleDryRun(config, upPlan(plan), report)
+	}
+	if len(plan) == 0 {
+		config.Logger().Info("No new migrations to apply")
+		return nil
+	}
+
+	config.Logger().Info("Applying migrations", "count", len(plan))
+	return withGlobalHooks(ctx, config, plan, func() error {
+		for _, migration := range plan {
+			if _, err := runApply(ctx, db, config, migration, older[migration], report); err != nil {
+				return err
 			}
+		}
+		return nil
+	})
+}
+
+// runApply applies the migration, adding the outcome to the report, the
+// execution log and the audit table, and logs it.
+func runApply(ctx context.Context, db *sql.DB, config config.Config, migration string, outOfOrder bool, report *Report) (Migration, error) {
+	config.Log = config.Logger().With("migration", migration, "direction", "up")
+	start, log := time.Now(), &executionLog{}
+	record, err := applyMigration(ctx, db, config, migration, log)
+	entry := report.record(appliedReport(config, record, outOfOrder), start, err)
+	saveExecutionLog(ctx, db, config, log, "up", start, entry)
+	recordAudit(ctx, db, config, EventApply, start, entry)
+	if err == nil {
+		logApplied(config, record, time.Since(start))
+	}
+	return record, err
+}
 
-			fmt.Printf("Successfully applied migration: %s\n", migration)
-			config.Commands.Steps = config.Commands.Steps - 1
+// runRevert reverts the migration, adding the outcome to the report, the
+// execution log and the audit table, and logs it. skipped tells that its
+// pre-up script skipped it, see revertMigration.
+func runRevert(ctx context.Context, db *sql.DB, config config.Config, migration string, skipped bool, report *Report) error {
+	config.Log = config.Logger().With("migration", migration, "direction", "down")
+	start, log := time.Now(), &executionLog{}
+	err := revertMigration(ctx, db, config, migration, skipped, log)
+	m := MigrationReport{Version: migration, State: StateReverted, Description: loadDescription(config, migration)}
+	if skipped {
+		m.Note = skippedRevertNote
+	}
+	entry := report.record(m, start, err)
+	saveExecutionLog(ctx, db, config, log, "down", start, entry)
+	recordAudit(ctx, db, config, EventRevert, start, entry)
+	switch {
+	case err == nil && skipped:
+		config.Logger().Info("Migration was skipped by its script, removed from the history without running down.sql", "duration", time.Since(start))
+	case err == nil:
+		config.Logger().Info("Migration reverted", "duration", time.Since(start))
+	}
+	return err
+}
+
+// skippedRevertNote is the note of reverting a migration its pre-up script
+// skipped.
+const skippedRevertNote = "skipped when applied, down.sql not run"
+
+// skippedMigrations returns the versions of the history entries whose
+// pre-up script skipped them.
+func skippedMigrations(historyMigrations []Migration) map[string]bool {
+	skipped := make(map[string]bool)
+	for _, m := range historyMigrations {
+		if m.Status == RecordSkipped {
+			skipped[m.Migration] = true
 		}
 	}
+	return skipped
+}
 
-	if len(newMigrations) == 0 {
-		fmt.Println("There are no new migrations to apply.")
+// appliedReport describes a migration run by applyMigration.
+func appliedReport(config config.Config, record Migration, outOfOrder bool) MigrationReport {
+	m := MigrationReport{Version: record.Migration, State: StateApplied, Description: loadDescription(config, record.Migration), OutOfOrder: outOfOrder}
+	switch record.Status {
+	case RecordSkipped:
+		m.State, m.AppliedAt = StateSkipped, appliedAt(record.AppliedAt)
+	case RecordDeferred:
+		m.State = StateDeferred
+	}
+	m.Recorded, m.Note = record.Status, record.Note
+	return m
+}
+
+// logApplied logs the outcome of a migration run by applyMigration.
+func logApplied(config config.Config, record Migration, duration time.Duration) {
+	switch record.Status {
+	case RecordSkipped:
+		config.Logger().Info("Migration skipped by its script, recorded as applied", "reason", record.Note, "duration", duration)
+	case RecordDeferred:
+		config.Logger().Info("Migration deferred by its script, left pending", "reason", record.Note, "duration", duration)
+	default:
+		config.Logger().Info("Migration applied", "duration", duration)
 	}
 }
 
-func handleDownCommand(db *sql.DB, config config.Config) {
-	fmt.Println("Migrations to remove:")
-	historyMigrations, err := LoadHistoryMigrations(db, config)
+// applyMigration runs the pre-up hook and the SQL of the migration,
+// records it in the history and runs its post-up hook, returning the
+// history entry. When the pre-up hook skips or defers the migration, its
+// SQL and post-up hook are not run.
+func applyMigration(ctx context.Context, db *sql.DB, config config.Config, migration string, log *executionLog) (Migration, error) {
+	record := Migration{Migration: migration}
+	if err := ctx.Err(); err != nil {
+		return record, interrupted(config, migration, err)
+	}
+
+	content, err := loadContent(filepath.Join(config.Path, migration, "up.sql"))
 	if err != nil {
-		log.Fatalf("Error querying migrations: %v", err)
+		return record, err
 	}
 
-	if config.Commands.Steps > 0 {
-		historyMigrations = getMigrationsWithSteps(config.Commands.Steps, historyMigrations)
+	decision, err := runHook(ctx, config, migration, PhasePreUp, log)
+	if err != nil {
+		if ctx.Err() != nil {
+			return record, interrupted(config, migration, ctx.Err())
+		}
+		return record, err
 	}
 
-	for _, m := range historyMigrations {
-		content := loadContent(filepath.Join(config.Path, m.Migration, "down.sql"))
+	if decision.Action == "" {
+		queries, start := SplitSQLQueries(content), time.Now()
+		err = RunQueriesInTransaction(ctx, db, config, queries)
+		log.step(fmt.Sprintf("up.sql, %d statement(s),", len(queries)), start, err)
+		if err != nil {
+			if ctx.Err() != nil {
+				return record, interrupted(config, migration, ctx.Err())
+			}
+			return record, fmt.Errorf("error applying migration: %v %v", migration, err)
+		}
+	}
+
+	record.AppliedAt, record.Status, record.Note = time.Now(), decision.status(), decision.Reason
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), bookkeepingTimeout)
+	err = RecordMigration(recordCtx, db, config, record)
+	cancel()
+	if err != nil {
+		return record, fmt.Errorf("error adding migration:%v %v", migration, err)
+	}
+	if decision.Action != "" {
+		return record, nil
+	}
+
+	if _, err := runHook(ctx, config, migration, PhasePostUp, log); err != nil {
+		return record, fmt.Errorf("migration %s was applied, but its %v", migration, err)
+	}
+
+	return record, nil
+}
 
-		err := RunQueriesInTransaction(db, SplitSQLQueries(content))
+func handleDownCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	if !config.Commands.DryRun {
+		release, err := acquireLock(ctx, db, config)
 		if err != nil {
-			log.Fatalf("Error run sql migration: %v", err)
+			return err
 		}
+		defer release()
+	}
 
-		if config.Commands.Debug {
-			fmt.Printf("-- DEBUG SQL: %s", content)
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
+	if err != nil {
+		return err
+	}
+
+	revert, missing, err := planRevert(config, historyMigrations, config.Commands.Steps)
+	if err != nil {
+		return err
+	}
+	skipped := skippedMigrations(historyMigrations)
+	if config.Commands.DryRun {
+		return handleDryRun(config, downPlan(revert, missing, skipped), report)
+	}
+	if err := confirmPlan(config, "revert", revertPlan(config, revert, missing, skipped)); err != nil {
+		return err
+	}
+	if len(revert) == 0 && len(missing) == 0 {
+		config.Logger().Info("No migrations to revert")
+		return nil
+	}
+
+	config.Logger().Info("Reverting migrations", "count", len(revert), "missing", len(missing))
+	return withGlobalHooks(ctx, config, changePlan(config, revert, missing), func() error {
+		if err := handleMissing(ctx, db, config, missing, report); err != nil {
+			return err
 		}
 
-		err = RemoveMigration(db, config, m.Migration)
+		for _, migration := range revert {
+			if err := runRevert(ctx, db, config, migration, skipped[migration], report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// revertMigration runs the pre-down hook and the down SQL of the
+// migration, removes it from the history and runs its post-down hook. The
+// SQL of a migration its pre-up script skipped never ran, so when skipped
+// is set only its history entry is removed, without running any script or
+// SQL.
+func revertMigration(ctx context.Context, db *sql.DB, config config.Config, migration string, skipped bool, log *executionLog) error {
+	if err := ctx.Err(); err != nil {
+		return interrupted(config, migration, err)
+	}
+
+	if skipped {
+		start := time.Now()
+		recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), bookkeepingTimeout)
+		err := RemoveMigration(recordCtx, db, config, migration)
+		cancel()
+		log.step("skipped when applied, removing from "+config.TableName, start, err)
 		if err != nil {
-			log.Fatalf("Error remove migration: %v", err)
+			return fmt.Errorf("error remove migration: %v", err)
 		}
+		return nil
+	}
 
-		scriptPath := filepath.Join(config.Path, m.Migration, "down.sh")
-		_, err = os.Stat(scriptPath)
-		if !os.IsNotExist(err) {
-			scriptPath := filepath.Join(config.Path, m.Migration, "down.sh")
-			if err := runBashScript(scriptPath, config); err != nil {
-				log.Fatalf("Failed to run script: %v", err)
-			}
+	content, err := loadContent(filepath.Join(config.Path, migration, "down.sql"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := runHook(ctx, config, migration, PhasePreDown, log); err != nil {
+		if ctx.Err() != nil {
+			return interrupted(config, migration, ctx.Err())
 		}
+		return err
+	}
 
-		fmt.Printf("Migration '%s' has been successfully removed.\n", m.Migration)
+	queries, start := SplitSQLQueries(content), time.Now()
+	err = RunQueriesInTransaction(ctx, db, config, queries)
+	log.step(fmt.Sprintf("down.sql, %d statement(s),", len(queries)), start, err)
+	if err != nil {
+		if ctx.Err() != nil {
+			return interrupted(config, migration, ctx.Err())
+		}
+		return fmt.Errorf("error run sql migration: %v", err)
 	}
 
-	if len(historyMigrations) == 0 {
-		fmt.Println("There is nothing to remove!")
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), bookkeepingTimeout)
+	err = RemoveMigration(recordCtx, db, config, migration)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("error remove migration: %v", err)
+	}
+
+	if _, err := runHook(ctx, config, migration, PhasePostDown, log); err != nil {
+		return fmt.Errorf("migration %s was reverted, but its %v", migration, err)
 	}
+
+	return nil
+}
+
+// interrupted reports a migration that was stopped by cancellation before
+// its transaction committed, so nothing of it was recorded.
+func interrupted(config config.Config, migration string, cause error) error {
+	config.Logger().Warn("Migration interrupted, changes rolled back and not recorded")
+	return fmt.Errorf("migration %s interrupted: %w", migration, cause)
 }
 
 func getMigrationsWithSteps(steps int, migrations []Migration) []Migration {
@@ -231,67 +578,100 @@ func SplitSQLQueries(sqlQueries string) []string {
 	return cleanedQueries
 }
 
-func loadContent(filePath string) string {
+func loadContent(filePath string) (string, error) {
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		log.Fatalf("File %s does not exist", filePath)
+		return "", fmt.Errorf("file %s does not exist", filePath)
 	}
 
 	content, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Fatalf("Error reading file %s: %v", filePath, err)
+		return "", fmt.Errorf("error reading file %s: %v", filePath, err)
 	}
 
-	return string(content)
+	return string(content), nil
 }
 
-func RunQueriesInTransaction(db *sql.DB, queries []string) error {
-	tx, err := db.Begin()
+// RunQueriesInTransaction executes queries in a single transaction, each
+// limited by config.StatementTimeout, logging every statement at the debug
+// level. The transaction is rolled back if any query fails or ctx is
+// cancelled.
+func RunQueriesInTransaction(ctx context.Context, db *sql.DB, config config.Config, queries []string) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("error beginning transaction: %v", err)
 	}
 	defer func() {
 		if err != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				log.Printf("Error rolling back transaction: %v", rbErr)
+			if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+				err = fmt.Errorf("%v (rollback failed: %v)", err, rbErr)
 			}
 			return
 		}
 		if commitErr := tx.Commit(); commitErr != nil {
-			log.Printf("Error committing transaction: %v", commitErr)
+			err = fmt.Errorf("error committing transaction: %v", commitErr)
 		}
 	}()
 
-	for _, query := range queries {
-		_, err := tx.Exec(query)
-		if err != nil {
-			return fmt.Errorf("error executing query: %v", err)
+	for i, query := range queries {
+		start := time.Now()
+		if err = execStatement(ctx, tx, config, query); err != nil {
+			return fmt.Errorf("error executing query %d: %w", i+1, err)
 		}
+		config.Logger().Debug("Statement executed", "statement", i+1, "sql", query, "duration", time.Since(start))
 	}
 
 	return nil
 }
 
-func AddMigration(db *sql.DB, config config.Config, migration string) error {
-	query := fmt.Sprintf("INSERT INTO %s (migration, applied_at) VALUES (?, ?)", config.TableName)
+func execStatement(ctx context.Context, tx *sql.Tx, config config.Config, query string) error {
+	if config.StatementTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.StatementTimeout)
+		defer cancel()
+	}
+
+	_, err := tx.ExecContext(ctx, query)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("statement timed out after %s: %w", config.StatementTimeout, ctx.Err())
+	}
+	return err
+}
+
+func AddMigration(ctx context.Context, db *sql.DB, config config.Config, migration string) error {
+	return RecordMigration(ctx, db, config, Migration{Migration: migration, AppliedAt: time.Now()})
+}
+
+// RecordMigration adds record to the history, with the checksum of the
+// migration's current files, replacing the entry of a deferred run.
+func RecordMigration(ctx context.Context, db execer, config config.Config, record Migration) error {
+	query := rebind(config, fmt.Sprintf("DELETE FROM %s WHERE migration = ? AND status = ?", config.TableName))
+	if _, err := db.ExecContext(ctx, query, record.Migration, RecordDeferred); err != nil {
+		return fmt.Errorf("error executing query: %v", err)
+	}
+
+	query = rebind(config, fmt.Sprintf("INSERT INTO %s (migration, applied_at, checksum, status, note) VALUES (?, ?, ?, ?, ?)", config.TableName))
 
-	record := Migration{
-		Migration: migration,
-		AppliedAt: time.Now(),
+	checksum, err := MigrationChecksum(config, record.Migration)
+	if err != nil {
+		return err
 	}
+	record.Checksum = checksum
+
+	status, note := nullString(record.Status), nullString(record.Note)
 
 	switch config.DBType {
 	case "mysql":
-		_, err := db.Exec(query, record.Migration, record.AppliedAt)
+		_, err := db.ExecContext(ctx, query, record.Migration, record.AppliedAt, record.Checksum, status, note)
 		if err != nil {
 			return fmt.Errorf("error executing query: %v", err)
 		}
 	case "sqlite":
-		_, err := db.Exec(query, record.Migration, record.AppliedAt.Format("2006-01-02 15:04:05"))
+		_, err := db.ExecContext(ctx, query, record.Migration, record.AppliedAt.Format("2006-01-02 15:04:05"), record.Checksum, status, note)
 		if err != nil {
 			return fmt.Errorf("error executing query: %v", err)
 		}
 	case "postgres":
-		_, err := db.Exec(query, record.Migration, record.AppliedAt)
+		_, err := db.ExecContext(ctx, query, record.Migration, record.AppliedAt, record.Checksum, status, note)
 		if err != nil {
 			return fmt.Errorf("error executing query: %v", err)
 		}
@@ -302,10 +682,14 @@ func AddMigration(db *sql.DB, config config.Config, migration string) error {
 	return nil
 }
 
-func RemoveMigration(db *sql.DB, config config.Config, migration string) error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE migration = ?", config.TableName)
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func RemoveMigration(ctx context.Context, db *sql.DB, config config.Config, migration string) error {
+	query := rebind(config, fmt.Sprintf("DELETE FROM %s WHERE migration = ?", config.TableName))
 
-	_, err := db.Exec(query, migration)
+	_, err := db.ExecContext(ctx, query, migration)
 	if err != nil {
 		return fmt.Errorf("error executing query: %v", err)
 	}
@@ -313,10 +697,22 @@ func RemoveMigration(db *sql.DB, config config.Config, migration string) error {
 	return nil
 }
 
-func LoadHistoryMigrations(db *sql.DB, config config.Config) ([]Migration, error) {
-	query := fmt.Sprintf("SELECT migration, applied_at FROM %s ORDER BY migration ASC", config.TableName)
+// LoadHistoryMigrations returns the applied migrations, oldest first.
+// Deferred migrations are not applied and are left out.
+func LoadHistoryMigrations(ctx context.Context, db *sql.DB, config config.Config) ([]Migration, error) {
+	return loadMigrations(ctx, db, config, "status IS NULL OR status <> ?", RecordDeferred)
+}
 
-	rows, err := db.Query(query)
+// LoadDeferredMigrations returns the migrations a script deferred to a
+// later run, oldest first.
+func LoadDeferredMigrations(ctx context.Context, db *sql.DB, config config.Config) ([]Migration, error) {
+	return loadMigrations(ctx, db, config, "status = ?", RecordDeferred)
+}
+
+func loadMigrations(ctx context.Context, db *sql.DB, config config.Config, where string, args ...interface{}) ([]Migration, error) {
+	query := rebind(config, fmt.Sprintf("SELECT migration, applied_at, checksum, status, note FROM %s WHERE %s ORDER BY migration ASC", config.TableName, where))
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("error querying migrations: %v", err)
 	}
@@ -326,19 +722,13 @@ func LoadHistoryMigrations(db *sql.DB, config config.Config) ([]Migration, error
 	for rows.Next() {
 		var m Migration
 		var appliedAtStr string
-		if err := rows.Scan(&m.Migration, &appliedAtStr); err != nil {
+		var checksum, status, note sql.NullString
+		if err := rows.Scan(&m.Migration, &appliedAtStr, &checksum, &status, &note); err != nil {
 			return nil, fmt.Errorf("error scanning migration row: %v", err)
 		}
+		m.Checksum, m.Status, m.Note = checksum.String, status.String, note.String
 
-		switch config.DBType {
-		case "mysql", "postgres":
-			m.AppliedAt, err = time.Parse("2006-01-02 15:04:05", appliedAtStr)
-		case "sqlite":
-			m.AppliedAt, err = time.Parse(time.RFC3339, appliedAtStr)
-		default:
-			return nil, fmt.Errorf("unsupported database type: %s", config.DBType)
-		}
-
+		m.AppliedAt, err = parseTimestamp(config, appliedAtStr)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing applied_at timestamp: %v", err)
 		}
@@ -353,15 +743,67 @@ func LoadHistoryMigrations(db *sql.DB, config config.Config) ([]Migration, error
 	return migrations, nil
 }
 
-func loadNewMigrations(db *sql.DB, config config.Config) []string {
-	entries, err := os.ReadDir(config.Path)
+// parseTimestamp parses applied_at as returned by the driver: MySQL sends
+// the column text, while the Postgres and SQLite drivers return time values
+// that database/sql formats as RFC 3339.
+func parseTimestamp(config config.Config, value string) (time.Time, error) {
+	switch config.DBType {
+	case "mysql", "postgres", "sqlite":
+	default:
+		return time.Time{}, fmt.Errorf("unsupported database type: %s", config.DBType)
+	}
+
+	var err error
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02 15:04:05.999999999-07:00"} {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// rebind replaces the ? placeholders of query with the $n placeholders
+// Postgres expects.
+func rebind(config config.Config, query string) string {
+	if config.DBType != "postgres" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// PendingMigrations returns the migrations on disk that are not in the
+// history yet, oldest first.
+func PendingMigrations(ctx context.Context, db *sql.DB, config config.Config) ([]string, error) {
+	return loadNewMigrations(ctx, db, config)
+}
+
+func loadNewMigrations(ctx context.Context, db *sql.DB, config config.Config) ([]string, error) {
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
 	if err != nil {
-		log.Fatalf("Error reading migration directory: %v", err)
+		return nil, fmt.Errorf("error loading migration history: %v", err)
 	}
 
-	historyMigrations, err := LoadHistoryMigrations(db, config)
+	return unappliedMigrations(config, historyMigrations)
+}
+
+// unappliedMigrations returns the migrations on disk that are not in
+// historyMigrations, oldest first.
+func unappliedMigrations(config config.Config, historyMigrations []Migration) ([]string, error) {
+	migrations, err := listMigrations(config)
 	if err != nil {
-		log.Fatalf("Error loading migration history: %v", err)
+		return nil, err
 	}
 
 	historySet := make(map[string]struct{})
@@ -370,29 +812,29 @@ func loadNewMigrations(db *sql.DB, config config.Config) []string {
 	}
 
 	var newMigrations []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			_, exists := historySet[entry.Name()]
-			if !exists {
-				newMigrations = append(newMigrations, entry.Name())
-			}
+	for _, migration := range migrations {
+		if _, exists := historySet[migration]; !exists {
+			newMigrations = append(newMigrations, migration)
 		}
 	}
 
-	sort.Strings(newMigrations)
-	return newMigrations
+	return newMigrations, nil
 }
 
-func runBashScript(scriptPath string, config config.Config) error {
-	cmd := exec.Command("/bin/bash", scriptPath)
-	output, err := cmd.CombinedOutput()
+// listMigrations returns the migration directories on disk, oldest first.
+func listMigrations(config config.Config) ([]string, error) {
+	entries, err := os.ReadDir(config.Path)
 	if err != nil {
-		return fmt.Errorf("error running script: %v\nOutput: %s", err, string(output))
+		return nil, fmt.Errorf("error reading migration directory: %v", err)
 	}
 
-	if config.Commands.Debug {
-		fmt.Printf("-- DEBUG SCRIPT: %s", string(output))
+	var migrations []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			migrations = append(migrations, entry.Name())
+		}
 	}
 
-	return nil
+	sort.Strings(migrations)
+	return migrations, nil
 }
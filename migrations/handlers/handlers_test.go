@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+func TestRebind(t *testing.T) {
+	query := "INSERT INTO t (a, b, c) VALUES (?, ?, ?)"
+	if got := rebind(config.Config{DBType: "postgres"}, query); got != "INSERT INTO t (a, b, c) VALUES ($1, $2, $3)" {
+		t.Errorf("Unexpected postgres query %q", got)
+	}
+	for _, dbType := range []string{"mysql", "sqlite"} {
+		if got := rebind(config.Config{DBType: dbType}, query); got != query {
+			t.Errorf("Expected the %s query unchanged, got %q", dbType, got)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 1, 5, 10, 12, 3, 0, time.UTC)
+	cases := []struct {
+		dbType string
+		value  string
+	}{
+		{"mysql", "2024-01-05 10:12:03"},
+		{"mysql", "2024-01-05 10:12:03.000"},
+		{"postgres", "2024-01-05T10:12:03Z"},
+		{"sqlite", "2024-01-05T10:12:03Z"},
+		{"sqlite", "2024-01-05 10:12:03+00:00"},
+	}
+
+	for _, c := range cases {
+		got, err := parseTimestamp(config.Config{DBType: c.dbType}, c.value)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseTimestamp(%s, %q) = %v, %v", c.dbType, c.value, got, err)
+		}
+	}
+
+	if _, err := parseTimestamp(config.Config{DBType: "sqlite"}, "yesterday"); err == nil {
+		t.Error("Expected an invalid timestamp to be rejected")
+	}
+	if _, err := parseTimestamp(config.Config{DBType: "oracle"}, "2024-01-05 10:12:03"); err == nil {
+		t.Error("Expected an unsupported database type to be rejected")
+	}
+}
+
+func TestScriptEnvHidesPassword(t *testing.T) {
+	cfg := config.Config{DBType: "postgres", DSN: "postgres://app:secret@db:5432/app"}
+	for _, kv := range scriptEnv(cfg) {
+		if strings.Contains(kv, "secret") {
+			t.Errorf("Expected the password to be hidden from scripts, got %s", kv)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// Phases of a migration that can run a hook script, named after the
+// script without its extension, e.g. pre-up.sh or pre-up.py.
+const (
+	PhasePreUp    = "pre-up"
+	PhasePostUp   = "post-up"
+	PhasePreDown  = "pre-down"
+	PhasePostDown = "post-down"
+)
+
+// NewRunID returns an identifier for one run of the tool, passed to hook
+// scripts so their logs can be correlated.
+func NewRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// runHook runs the hook script of the phase, if the migration has one,
+// and returns what it decided. Only pre-up scripts may skip or defer the
+// migration.
+func runHook(ctx context.Context, config config.Config, migration, phase string, log *executionLog) (decision, error) {
+	scriptPath, err := findHook(config, migration, phase)
+	if err != nil || scriptPath == "" {
+		return decision{}, err
+	}
+	if scriptPath, err = filepath.Abs(scriptPath); err != nil {
+		return decision{}, fmt.Errorf("error resolving %s script: %v", phase, err)
+	}
+
+	start := time.Now()
+	d, err := runScript(ctx, scriptPath, config, migration+" "+phase, hookEnv(config, migration, phase), log, phase == PhasePreUp)
+	if err == nil && d.Action != "" && phase != PhasePreUp {
+		err = fmt.Errorf("only pre-up scripts can %s their migration", d.Action)
+	}
+	log.step(fmt.Sprintf("%s script %s", phase, filepath.Base(scriptPath)), start, err)
+	if err != nil {
+		return decision{}, fmt.Errorf("%s script %s failed: %v", phase, filepath.Base(scriptPath), err)
+	}
+	return d, nil
+}
+
+// findHook returns the path of the hook script of the phase, or an empty
+// string when there is none.
+func findHook(config config.Config, migration, phase string) (string, error) {
+	meta, err := loadMeta(config, migration)
+	if err != nil {
+		return "", err
+	}
+
+	scripts, err := findScripts(config, migration, scriptNames(meta, phase)...)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(scripts) {
+	case 0:
+		return "", nil
+	case 1:
+		return scripts[0], nil
+	default:
+		var found []string
+		for _, script := range scripts {
+			found = append(found, filepath.Base(script))
+		}
+		return "", fmt.Errorf("migration %s has several scripts for the %s phase (%s), keep one of them",
+			migration, phase, strings.Join(found, ", "))
+	}
+}
+
+// hookEnv returns the environment of a hook script of the migration.
+func hookEnv(config config.Config, migration, phase string) []string {
+	direction := strings.TrimPrefix(strings.TrimPrefix(phase, "pre-"), "post-")
+	path := absPath(config.Path)
+
+	return append(scriptEnv(config),
+		"MIGRATION_VERSION="+migration,
+		"MIGRATION_DIRECTION="+direction,
+		"MIGRATION_PHASE="+phase,
+		"MIGRATION_DIR="+filepath.Join(path, migration),
+	)
+}
+
+// scriptEnv returns the environment shared by all scripts: the variables
+// of the tool's environment allowed by config.ScriptEnv, plus variables
+// describing the run and the database. Paths are absolute, as scripts run
+// in their own directory.
+func scriptEnv(config config.Config) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); config.ScriptEnv.Allows(name) {
+			env = append(env, kv)
+		}
+	}
+
+	return append(env,
+		"MIGRATION_COMMAND="+config.Command,
+		"MIGRATION_PATH="+absPath(config.Path),
+		"MIGRATION_RUN_ID="+config.RunID,
+		"MIGRATION_DIALECT="+config.DBType,
+		"DB_TYPE="+config.DBType,
+		"DB_HOST="+config.Addr,
+		"DB_PORT="+config.Port,
+		"DB_NAME="+config.DBName,
+		"DB_USER="+config.User,
+		"DB_SCHEMA="+config.Schema,
+		"DB_TABLE="+config.TableName,
+		"DB_DSN="+config.RedactedDSN(),
+		"DB_PASSWORD_FILE="+config.PasswdFile,
+		"DB_PASSWORD_COMMAND="+config.PasswdCommand,
+	)
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Results of a run passed to the after-all hook as MIGRATION_RESULT.
+const (
+	ResultSuccess     = "success"
+	ResultFailure     = "failure"
+	ResultInterrupted = "interrupted"
+)
+
+// interruptedAfterAllTimeout limits the after-all hook of an interrupted
+// run when -script-timeout does not, so cleanup cannot keep the tool
+// running after a signal or -timeout.
+const interruptedAfterAllTimeout = time.Minute
+
+// withGlobalHooks runs the before-all hook, then run, then the after-all
+// hook, when plan, the migrations run will change, is not empty. A failing
+// before-all hook aborts the run. The after-all hook runs whatever the
+// result, even after cancellation, and is told the result.
+func withGlobalHooks(ctx context.Context, config config.Config, plan []string, run func() error) error {
+	if len(plan) == 0 {
+		return run()
+	}
+
+	env := append(scriptEnv(config),
+		"MIGRATION_PLAN="+strings.Join(plan, " "),
+		"MIGRATION_COUNT="+strconv.Itoa(len(plan)),
+	)
+
+	if config.BeforeAll != "" {
+		if err := runGlobalHook(ctx, config, config.BeforeAll, "before-all", env); err != nil {
+			return fmt.Errorf("before-all script %s failed, no migration was run: %w", config.BeforeAll, err)
+		}
+	}
+
+	err := run()
+	if config.AfterAll == "" {
+		return err
+	}
+
+	result, message := ResultSuccess, ""
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		result, message = ResultInterrupted, err.Error()
+	case err != nil:
+		result, message = ResultFailure, err.Error()
+	}
+	env = append(env, "MIGRATION_RESULT="+result, "MIGRATION_ERROR="+message)
+
+	hookConfig := config
+	if result == ResultInterrupted && hookConfig.ScriptTimeout == 0 {
+		hookConfig.ScriptTimeout = interruptedAfterAllTimeout
+	}
+	if hookErr := runGlobalHook(context.WithoutCancel(ctx), hookConfig, config.AfterAll, "after-all", env); hookErr != nil {
+		if err != nil {
+			return fmt.Errorf("%w (after-all script %s failed as well: %v)", err, config.AfterAll, hookErr)
+		}
+		return fmt.Errorf("migrations completed, but after-all script %s failed: %w", config.AfterAll, hookErr)
+	}
+	return err
+}
+
+// runGlobalHook runs the before-all or after-all script. They cannot skip
+// or defer anything, so a "migrate:" line fails them like any non-zero
+// exit code.
+func runGlobalHook(ctx context.Context, config config.Config, script, name string, env []string) error {
+	d, err := runScript(ctx, absPath(script), config, name, env, nil, false)
+	if err == nil && d.Action != "" {
+		err = fmt.Errorf("only pre-up scripts can %s their migration", d.Action)
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// handleMarkAppliedCommand records a migration of the migration directory
+// as applied without running it, e.g. after it was applied by hand.
+func handleMarkAppliedCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	version := config.Commands.Version
+
+	release, err := acquireLock(ctx, db, config)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	onDisk, err := listMigrations(config)
+	if err != nil {
+		return err
+	}
+	if !contains(onDisk, version) {
+		return fmt.Errorf("migration %s not found in %s", version, config.Path)
+	}
+
+	record, err := findHistoryMigration(ctx, db, config, version)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		return fmt.Errorf("migration %s is already applied", version)
+	}
+
+	if err := confirm(config, fmt.Sprintf("Mark migration %s as applied without running it?", version)); err != nil {
+		return err
+	}
+
+	m := Migration{Migration: version, AppliedAt: time.Now(), Status: RecordManual, Note: config.Commands.Note}
+	entry := MigrationReport{
+		Version:     version,
+		State:       StateApplied,
+		AppliedAt:   appliedAt(m.AppliedAt),
+		Description: loadDescription(config, version),
+		Recorded:    m.Status,
+		Note:        m.Note,
+	}
+	if err := RecordMigration(ctx, db, config, m); err != nil {
+		err = fmt.Errorf("error adding migration: %v %v", version, err)
+		recordAudit(ctx, db, config, EventMarkApplied, m.AppliedAt, failedEntry(entry, err))
+		return err
+	}
+	recordAudit(ctx, db, config, EventMarkApplied, m.AppliedAt, entry)
+
+	report.add(entry)
+	config.Logger().Info("Migration marked as applied", "migration", version, "direction", "up", "note", m.Note)
+	return nil
+}
+
+// handleMarkUnappliedCommand removes a migration from the history without
+// reverting it, e.g. after it was reverted by hand.
+func handleMarkUnappliedCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	version := config.Commands.Version
+
+	release, err := acquireLock(ctx, db, config)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	record, err := findHistoryMigration(ctx, db, config, version)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("migration %s is not applied", version)
+	}
+
+	if err := confirm(config, fmt.Sprintf("Mark migration %s as unapplied without reverting it?", version)); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	entry := MigrationReport{Version: version, State: StateUnapplied, Description: loadDescription(config, version), Note: config.Commands.Note}
+	if err := RemoveMigration(ctx, db, config, version); err != nil {
+		err = fmt.Errorf("error remove migration: %v", err)
+		recordAudit(ctx, db, config, EventMarkUnapplied, start, failedEntry(entry, err))
+		return err
+	}
+	recordAudit(ctx, db, config, EventMarkUnapplied, start, entry)
+
+	report.add(entry)
+	config.Logger().Info("Migration marked as unapplied", "migration", version, "direction", "down", "note", config.Commands.Note)
+	return nil
+}
+
+// findHistoryMigration returns the history entry of version, or nil when
+// it is not applied.
+func findHistoryMigration(ctx context.Context, db *sql.DB, config config.Config, version string) (*Migration, error) {
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range historyMigrations {
+		if m.Migration == version {
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
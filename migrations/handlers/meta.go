@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// MetaFile is the optional file of a migration describing how it runs.
+const MetaFile = "meta.yaml"
+
+// When the up.* and down.* scripts of a migration run relative to its SQL.
+const (
+	ScriptBefore = "before"
+	ScriptAfter  = "after"
+	ScriptBoth   = "both"
+)
+
+// Meta is the content of a migration's meta.yaml:
+//
+//	up:
+//	  script: before
+//	down:
+//	  script: after
+type Meta struct {
+	Up   DirectionMeta `yaml:"up"`
+	Down DirectionMeta `yaml:"down"`
+}
+
+// DirectionMeta describes one direction of a migration. Script tells when
+// its up.* or down.* script runs: before, after or both around the SQL.
+type DirectionMeta struct {
+	Script string `yaml:"script"`
+}
+
+// loadMeta reads the meta.yaml of the migration, defaulting to the order
+// used before it existed: up.* before the SQL, down.* after it.
+func loadMeta(config config.Config, migration string) (Meta, error) {
+	meta := Meta{Up: DirectionMeta{Script: ScriptBefore}, Down: DirectionMeta{Script: ScriptAfter}}
+
+	content, err := os.ReadFile(filepath.Join(config.Path, migration, MetaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, fmt.Errorf("error reading %s of migration %s: %v", MetaFile, migration, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&meta); err != nil && !errors.Is(err, io.EOF) {
+		return meta, fmt.Errorf("error parsing %s of migration %s: %v", MetaFile, migration, err)
+	}
+
+	for _, script := range []string{meta.Up.Script, meta.Down.Script} {
+		switch script {
+		case ScriptBefore, ScriptAfter, ScriptBoth:
+		default:
+			return meta, fmt.Errorf("invalid script order %q in %s of migration %s, use before, after or both", script, MetaFile, migration)
+		}
+	}
+	return meta, nil
+}
+
+// scriptNames returns the names, without extension, of the scripts run in
+// the phase: the phase's own hook, and the up.* or down.* script when the
+// migration's meta.yaml runs it then.
+func scriptNames(meta Meta, phase string) []string {
+	names := []string{phase}
+
+	var direction DirectionMeta
+	var name, at string
+	switch phase {
+	case PhasePreUp:
+		direction, name, at = meta.Up, "up", ScriptBefore
+	case PhasePostUp:
+		direction, name, at = meta.Up, "up", ScriptAfter
+	case PhasePreDown:
+		direction, name, at = meta.Down, "down", ScriptBefore
+	case PhasePostDown:
+		direction, name, at = meta.Down, "down", ScriptAfter
+	}
+	if direction.Script == at || direction.Script == ScriptBoth {
+		names = append(names, name)
+	}
+	return names
+}
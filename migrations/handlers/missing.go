@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// planRevert selects the latest steps history entries, or all of them when
+// steps is below 1, newest first, and checks their files before anything is
+// reverted. Entries whose migration directory no longer exists are returned
+// as missing if the -missing policy is skip or purge, and fail the plan
+// otherwise.
+func planRevert(config config.Config, historyMigrations []Migration, steps int) (revert, missing []string, err error) {
+	if steps > 0 {
+		historyMigrations = getMigrationsWithSteps(steps, historyMigrations)
+	}
+
+	for i := len(historyMigrations) - 1; i >= 0; i-- {
+		version := historyMigrations[i].Migration
+		dir := filepath.Join(config.Path, version)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			missing = append(missing, version)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, "down.sql")); err != nil {
+			return nil, nil, fmt.Errorf("migration %s cannot be reverted, nothing was changed: %v", version, err)
+		}
+		if _, err := loadMeta(config, version); err != nil {
+			return nil, nil, fmt.Errorf("migration %s cannot be reverted, nothing was changed: %v", version, err)
+		}
+		revert = append(revert, version)
+	}
+
+	if len(missing) > 0 && config.Commands.Missing != "skip" && config.Commands.Missing != "purge" {
+		return nil, nil, fmt.Errorf("%d applied migration(s) have no files in %s: %s; nothing was changed, use -missing skip or -missing purge",
+			len(missing), config.Path, strings.Join(missing, ", "))
+	}
+
+	return revert, missing, nil
+}
+
+// revertPlan describes the migrations selected by planRevert, in the
+// order they are handled, for the confirmation prompt.
+func revertPlan(config config.Config, revert, missing []string, skipped map[string]bool) []string {
+	var plan []string
+	for _, version := range missing {
+		plan = append(plan, fmt.Sprintf("%s  (no files, %s)", version, config.Commands.Missing))
+	}
+	for _, version := range revert {
+		line := strings.TrimSpace(version + "  " + loadDescription(config, version))
+		if skipped[version] {
+			line += "  (" + skippedRevertNote + ")"
+		}
+		plan = append(plan, line)
+	}
+	return plan
+}
+
+// handleMissing leaves the missing migrations in the history with -missing
+// skip, and removes them from it without running anything with purge.
+func handleMissing(ctx context.Context, db *sql.DB, config config.Config, missing []string, report *Report) error {
+	for _, version := range missing {
+		if config.Commands.Missing != "purge" {
+			report.add(MigrationReport{Version: version, State: StateMissing})
+			config.Logger().Warn("Migration has no files, skipped", "migration", version, "direction", "down")
+			continue
+		}
+
+		start, entry := time.Now(), MigrationReport{Version: version, State: StatePurged}
+		if err := RemoveMigration(ctx, db, config, version); err != nil {
+			err = fmt.Errorf("error remove migration: %v", err)
+			recordAudit(ctx, db, config, EventPurge, start, failedEntry(entry, err))
+			return err
+		}
+		recordAudit(ctx, db, config, EventPurge, start, entry)
+		report.add(entry)
+		config.Logger().Info("Migration has no files, removed from the history", "migration", version, "direction", "down")
+	}
+
+	return nil
+}
+
+// changePlan returns the migrations whose history entries a revert
+// changes: the reverted ones, and the missing ones when they are purged.
+func changePlan(config config.Config, revert, missing []string) []string {
+	if config.Commands.Missing != "purge" {
+		return revert
+	}
+	return append(revert[:len(revert):len(revert)], missing...)
+}
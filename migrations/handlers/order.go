@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// outOfOrder returns the pending migrations older than the newest applied
+// one, typically merged from a branch after newer migrations were applied,
+// and that newest applied version.
+func outOfOrder(historyMigrations []Migration, pending []string) (map[string]bool, string) {
+	latest := ""
+	for _, m := range historyMigrations {
+		if m.Migration > latest {
+			latest = m.Migration
+		}
+	}
+
+	older := make(map[string]bool)
+	for _, migration := range pending {
+		if migration < latest {
+			older[migration] = true
+		}
+	}
+	return older, latest
+}
+
+// checkOrder applies the -out-of-order policy before pending migrations
+// are applied: error refuses to apply any of them, warn logs a warning
+// and allow applies them silently.
+func checkOrder(config config.Config, pending []string, older map[string]bool, latest string) error {
+	if len(older) == 0 {
+		return nil
+	}
+
+	var versions []string
+	for _, migration := range pending {
+		if older[migration] {
+			versions = append(versions, migration)
+		}
+	}
+	switch config.OutOfOrder {
+	case "allow":
+		return nil
+	case "error":
+		return fmt.Errorf("%d pending migration(s) older than the latest applied migration %s: %s; apply them with -out-of-order allow", len(versions), latest, strings.Join(versions, ", "))
+	default:
+		config.Logger().Warn("Pending migrations older than the latest applied one, applying them out of order", "latest", latest, "migrations", strings.Join(versions, ", "))
+		return nil
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// StatePlanned is the state of the migrations listed by -dry-run.
+const StatePlanned = "planned"
+
+// plannedMigration is a migration -dry-run lists, run in direction "up"
+// or "down", or a missing one handled by the -missing policy. Skipped is
+// set for a migration reverted after its pre-up script skipped it.
+type plannedMigration struct {
+	Version   string
+	Direction string
+	Missing   bool
+	Skipped   bool
+}
+
+// handleDryRun prints what running the migrations would do, step by step
+// in the order they would run, without changing anything.
+func handleDryRun(config config.Config, planned []plannedMigration, report *Report) error {
+	var entries []MigrationReport
+	for _, p := range planned {
+		steps, err := migrationSteps(config, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, MigrationReport{Version: p.Version, State: StatePlanned, Description: loadDescription(config, p.Version), Direction: p.Direction, Steps: steps})
+	}
+
+	for _, entry := range entries {
+		report.add(entry)
+	}
+	if config.Structured() {
+		return nil
+	}
+
+	fmt.Fprintf(config.Out(), "Dry run of %s, nothing is changed:\n", config.Command)
+	if len(entries) == 0 {
+		fmt.Fprintln(config.Out(), "There is nothing to run.")
+		return nil
+	}
+	if config.BeforeAll != "" {
+		fmt.Fprintf(config.Out(), "Before all: run %s\n", config.BeforeAll)
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(config.Out(), "Migration %s %s", entry.Direction, entry.Version)
+		if entry.Description != "" {
+			fmt.Fprintf(config.Out(), " (%s)", entry.Description)
+		}
+		fmt.Fprintln(config.Out(), ":")
+		for i, step := range entry.Steps {
+			fmt.Fprintf(config.Out(), "  %d. %s\n", i+1, step)
+		}
+	}
+	if config.AfterAll != "" {
+		fmt.Fprintf(config.Out(), "After all: run %s\n", config.AfterAll)
+	}
+	return nil
+}
+
+// migrationSteps returns the steps of running the migration, in order.
+func migrationSteps(config config.Config, p plannedMigration) ([]string, error) {
+	if p.Missing {
+		if config.Commands.Missing == "purge" {
+			return []string{fmt.Sprintf("remove from %s, the migration has no files", config.TableName)}, nil
+		}
+		return []string{"skip, the migration has no files"}, nil
+	}
+	if p.Skipped && p.Direction == "down" {
+		return []string{fmt.Sprintf("remove from %s, the migration was skipped by its pre-up script and down.sql is not run", config.TableName)}, nil
+	}
+
+	pre, post, sqlFile, bookkeeping := PhasePreUp, PhasePostUp, "up.sql", "record in "+config.TableName
+	if p.Direction == "down" {
+		pre, post, sqlFile, bookkeeping = PhasePreDown, PhasePostDown, "down.sql", "remove from "+config.TableName
+	}
+
+	content, err := loadContent(filepath.Join(config.Path, p.Version, sqlFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []string
+	for _, phase := range []string{pre, "sql", post} {
+		if phase == "sql" {
+			steps = append(steps, fmt.Sprintf("run %s (%d statement(s))", sqlFile, len(SplitSQLQueries(content))), bookkeeping)
+			continue
+		}
+
+		scriptPath, err := findHook(config, p.Version, phase)
+		if err != nil {
+			return nil, err
+		}
+		if scriptPath != "" {
+			steps = append(steps, fmt.Sprintf("run %s (%s script)", filepath.Base(scriptPath), phase))
+		}
+	}
+	return steps, nil
+}
+
+// upPlan and downPlan list the migrations up and down would run.
+func upPlan(migrations []string) []plannedMigration {
+	var planned []plannedMigration
+	for _, version := range migrations {
+		planned = append(planned, plannedMigration{Version: version, Direction: "up"})
+	}
+	return planned
+}
+
+func downPlan(revert, missing []string, skipped map[string]bool) []plannedMigration {
+	var planned []plannedMigration
+	for _, version := range missing {
+		planned = append(planned, plannedMigration{Version: version, Direction: "down", Missing: true})
+	}
+	for _, version := range revert {
+		planned = append(planned, plannedMigration{Version: version, Direction: "down", Skipped: skipped[version]})
+	}
+	return planned
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// handleRedoCommand reverts the latest config.Commands.Steps migrations,
+// newest first, and applies them again, holding the migration lock
+// throughout. If a migration cannot be reverted nothing is reapplied, so
+// the migrations reverted before it stay pending. Migrations whose files
+// are missing cannot be reapplied and are handled by the -missing policy.
+func handleRedoCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	if !config.Commands.DryRun {
+		release, err := acquireLock(ctx, db, config)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
+	if err != nil {
+		return err
+	}
+
+	revert, missing, err := planRevert(config, historyMigrations, config.Commands.Steps)
+	if err != nil {
+		return err
+	}
+	skipped := skippedMigrations(historyMigrations)
+	if config.Commands.DryRun {
+		planned := downPlan(revert, missing, skipped)
+		for i := len(revert) - 1; i >= 0; i-- {
+			planned = append(planned, plannedMigration{Version: revert[i], Direction: "up"})
+		}
+		return handleDryRun(config, planned, report)
+	}
+	if err := confirmPlan(config, "redo", revertPlan(config, revert, missing, skipped)); err != nil {
+		return err
+	}
+	if len(revert) == 0 && len(missing) == 0 {
+		config.Logger().Info("No migrations to redo")
+		return nil
+	}
+
+	config.Logger().Info("Redoing migrations", "count", len(revert), "missing", len(missing))
+
+	return withGlobalHooks(ctx, config, changePlan(config, revert, missing), func() error {
+		if err := handleMissing(ctx, db, config, missing, report); err != nil {
+			return err
+		}
+		if len(revert) == 0 {
+			config.Logger().Info("No migrations to redo")
+			return nil
+		}
+		return redoMigrations(ctx, db, config, revert, skipped, report)
+	})
+}
+
+// redoMigrations reverts the migrations, newest first, and applies the
+// reverted ones again. Those in skipped were skipped by their pre-up
+// script and are only removed from the history before they are reapplied.
+func redoMigrations(ctx context.Context, db *sql.DB, config config.Config, revert []string, skipped map[string]bool, report *Report) error {
+	var reverted []string
+	for _, migration := range revert {
+		if err := runRevert(ctx, db, config, migration, skipped[migration], report); err != nil {
+			if len(reverted) > 0 {
+				return fmt.Errorf("redo stopped, %d migration(s) reverted but not reapplied, run 'migrate up' to apply them: %w", len(reverted), err)
+			}
+			return err
+		}
+		reverted = append(reverted, migration)
+	}
+
+	for i := len(reverted) - 1; i >= 0; i-- {
+		migration := reverted[i]
+
+		if _, err := runApply(ctx, db, config, migration, false, report); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// acquireLock takes a session-level advisory lock on the migration table,
+// so two runs cannot change it at the same time, waiting for a run that
+// holds it already. The lock lives on a dedicated connection that release
+// unlocks and closes. SQLite databases are local files and are not locked.
+func acquireLock(ctx context.Context, db *sql.DB, config config.Config) (release func(), err error) {
+	var tryLock, lock, unlock string
+	var key interface{}
+	switch config.DBType {
+	case "sqlite":
+		return func() {}, nil
+	case "postgres":
+		hash := fnv.New64a()
+		fmt.Fprintf(hash, "%s.%s", config.Schema, config.TableName)
+		tryLock, lock, unlock = "SELECT pg_try_advisory_lock($1)", "SELECT pg_advisory_lock($1)", "SELECT pg_advisory_unlock($1)"
+		key = int64(hash.Sum64())
+	case "mysql":
+		// Named locks are server-wide, so the name includes the database.
+		tryLock = "SELECT GET_LOCK(CONCAT('migrate:', DATABASE(), '.', ?), 0)"
+		lock = "SELECT GET_LOCK(CONCAT('migrate:', DATABASE(), '.', ?), -1)"
+		unlock = "SELECT RELEASE_LOCK(CONCAT('migrate:', DATABASE(), '.', ?))"
+		key = config.TableName
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", config.DBType)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error opening the lock connection: %v", err)
+	}
+
+	var acquired sql.NullBool
+	if err := conn.QueryRowContext(ctx, tryLock, key).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error acquiring the migration lock: %v", err)
+	}
+	if !acquired.Bool {
+		config.Logger().Info("Waiting for the migration lock held by another run")
+		if _, err := conn.ExecContext(ctx, lock, key); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error acquiring the migration lock: %v", err)
+		}
+	}
+
+	return func() {
+		unlockCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), bookkeepingTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(unlockCtx, unlock, key); err != nil {
+			config.Logger().Warn("Error releasing the migration lock", "error", err)
+		}
+		conn.Close()
+	}, nil
+}
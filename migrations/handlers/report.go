@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Migration states reported by the commands that change the history, in
+// addition to the states of the status command.
+const (
+	StateReverted    = "reverted"
+	StateFailed      = "failed"
+	StateInterrupted = "interrupted"
+	StateCreated     = "created"
+	StateUnapplied   = "unapplied"
+	StatePurged      = "purged"
+	StateSkipped     = "skipped"
+	StateDeferred    = "deferred"
+)
+
+// Report is the result of a command as printed by -output json or yaml.
+// The field names are a documented interface: add fields, but do not
+// rename or remove them. Events is only set by the audit command.
+type Report struct {
+	Command        string            `json:"command" yaml:"command"`
+	RunID          string            `json:"run_id" yaml:"run_id"`
+	Migrations     []MigrationReport `json:"migrations" yaml:"migrations"`
+	Events         []AuditEvent      `json:"events,omitempty" yaml:"events,omitempty"`
+	Summary        map[string]int    `json:"summary" yaml:"summary"`
+	CurrentVersion string            `json:"current_version,omitempty" yaml:"current_version,omitempty"`
+	DurationMs     int64             `json:"duration_ms" yaml:"duration_ms"`
+	Error          string            `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// MigrationReport is one migration of a Report. DurationMs is only set for
+// migrations run by the command, AppliedAt only for applied ones,
+// Recorded only for history entries recorded without running the
+// migration, Direction and Steps only for -dry-run, and Runs only for
+// history with a version.
+type MigrationReport struct {
+	Version     string      `json:"version" yaml:"version"`
+	State       string      `json:"state" yaml:"state"`
+	AppliedAt   *time.Time  `json:"applied_at,omitempty" yaml:"applied_at,omitempty"`
+	Description string      `json:"description,omitempty" yaml:"description,omitempty"`
+	DurationMs  *int64      `json:"duration_ms,omitempty" yaml:"duration_ms,omitempty"`
+	Recorded    string      `json:"recorded,omitempty" yaml:"recorded,omitempty"`
+	Note        string      `json:"note,omitempty" yaml:"note,omitempty"`
+	OutOfOrder  bool        `json:"out_of_order,omitempty" yaml:"out_of_order,omitempty"`
+	Direction   string      `json:"direction,omitempty" yaml:"direction,omitempty"`
+	Steps       []string    `json:"steps,omitempty" yaml:"steps,omitempty"`
+	Runs        []RunReport `json:"runs,omitempty" yaml:"runs,omitempty"`
+	Error       string      `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// RunReport is an execution log entry of a migration, listed by history
+// with a version.
+type RunReport struct {
+	RunID      string    `json:"run_id,omitempty" yaml:"run_id,omitempty"`
+	Direction  string    `json:"direction" yaml:"direction"`
+	State      string    `json:"state" yaml:"state"`
+	StartedAt  time.Time `json:"started_at" yaml:"started_at"`
+	DurationMs int64     `json:"duration_ms" yaml:"duration_ms"`
+	Output     string    `json:"output,omitempty" yaml:"output,omitempty"`
+	Error      string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// NewReport returns an empty report of the command.
+func NewReport(command string) *Report {
+	return &Report{Command: command, Migrations: []MigrationReport{}, Summary: map[string]int{}}
+}
+
+func (r *Report) add(m MigrationReport) {
+	r.Migrations = append(r.Migrations, m)
+	r.Summary[m.State]++
+}
+
+// record adds a migration run by the command since start and returns the
+// added entry. A failed run is reported as interrupted when it was stopped
+// by cancellation.
+func (r *Report) record(m MigrationReport, start time.Time, err error) MigrationReport {
+	duration := time.Since(start).Milliseconds()
+	m.DurationMs = &duration
+
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		m.State, m.Error = StateInterrupted, err.Error()
+	case err != nil:
+		m.State, m.Error = StateFailed, err.Error()
+	case m.State == StateApplied:
+		now := time.Now()
+		m.AppliedAt = &now
+	}
+
+	r.add(m)
+	return m
+}
+
+func appliedAt(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// WriteReport writes v, usually a Report, in the given output format.
+func WriteReport(w io.Writer, format string, v interface{}) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(v); err != nil {
+			return err
+		}
+		return encoder.Close()
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// defaultInterpreters run scripts that have neither a shebang line nor an
+// interpreter given with -interpreters. They are looked up in PATH.
+var defaultInterpreters = map[string]string{
+	".sh": "bash",
+	".py": "python3",
+	".js": "node",
+}
+
+// findScripts returns the scripts of the migration whose name, without the
+// extension, is one of names. SQL files and descriptions are not scripts.
+func findScripts(config config.Config, migration string, names ...string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(config.Path, migration))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading migration %s: %v", migration, err)
+	}
+
+	var scripts []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || ext == ".sql" || ext == ".txt" {
+			continue
+		}
+		if contains(names, strings.TrimSuffix(entry.Name(), ext)) {
+			scripts = append(scripts, filepath.Join(config.Path, migration, entry.Name()))
+		}
+	}
+	return scripts, nil
+}
+
+// scriptCommand returns the command line running the script: the
+// interpreter configured for its extension, else its shebang line, else
+// the default interpreter of its extension.
+func scriptCommand(config config.Config, scriptPath string) ([]string, error) {
+	ext := filepath.Ext(scriptPath)
+	if interpreter, ok := config.Interpreters[ext]; ok {
+		return append(strings.Fields(interpreter), scriptPath), nil
+	}
+
+	shebang, err := readShebang(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	if shebang != nil {
+		return append(shebang, scriptPath), nil
+	}
+
+	if interpreter, ok := defaultInterpreters[ext]; ok {
+		return []string{interpreter, scriptPath}, nil
+	}
+	return nil, fmt.Errorf("no interpreter for %s, add a shebang line or set one with -interpreters", filepath.Base(scriptPath))
+}
+
+// readShebang returns the interpreter and its optional argument from the
+// "#!" line of the script, or nil when it has none. As on Linux, all text
+// after the interpreter is a single argument.
+func readShebang(scriptPath string) ([]string, error) {
+	file, err := os.Open(scriptPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading script: %v", err)
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, nil
+	}
+	line, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), "#!")
+	if !ok {
+		return nil, nil
+	}
+
+	interpreter, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if interpreter == "" {
+		return nil, fmt.Errorf("empty shebang line in %s", filepath.Base(scriptPath))
+	}
+	if arg = strings.TrimSpace(arg); arg != "" {
+		return []string{interpreter, arg}, nil
+	}
+	return []string{interpreter}, nil
+}
+
+// Exit codes by which a pre-up script skips or defers its migration, as
+// an alternative to printing a "migrate:skip" or "migrate:defer" line.
+const (
+	exitSkip  = 77
+	exitDefer = 75
+)
+
+// decision is what a script asked the tool to do with its migration:
+// nothing, "skip" or "defer", and why.
+type decision struct {
+	Action string
+	Reason string
+}
+
+// status returns the history status recording the decision.
+func (d decision) status() string {
+	switch d.Action {
+	case "skip":
+		return RecordSkipped
+	case "defer":
+		return RecordDeferred
+	default:
+		return ""
+	}
+}
+
+// runScript runs the script in its directory with the environment env and
+// waits for it to finish, streaming its output line by line to
+// config.Out() with prefix and to capture, if not nil, and returns the
+// decision it made. Only when decides is set do the exit codes exitSkip and
+// exitDefer count as a decision rather than a failure. Cancelling
+// ctx or exceeding config.ScriptTimeout kills the script and every process
+// it started; output still held open by its children is abandoned after
+// scriptWaitDelay. The error includes the last lines of the output.
+func runScript(ctx context.Context, scriptPath string, config config.Config, prefix string, env []string, capture io.Writer, decides bool) (decision, error) {
+	args, err := scriptCommand(config, scriptPath)
+	if err != nil {
+		return decision{}, err
+	}
+	if !config.ScriptLimits.IsZero() {
+		if args, err = limitResources(args, config.ScriptLimits); err != nil {
+			return decision{}, err
+		}
+	}
+
+	parent := ctx
+	if config.ScriptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ScriptTimeout)
+		defer cancel()
+	}
+
+	output := &scriptOutput{out: config.Out(), capture: capture, prefix: prefix}
+	if config.LogFormat == "json" {
+		output.log = config.Logger().With("script", filepath.Base(scriptPath))
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = filepath.Dir(scriptPath)
+	cmd.Env = env
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = scriptWaitDelay
+	killProcessGroup(cmd)
+
+	err = cmd.Run()
+	output.Flush()
+	if ctx.Err() != nil && parent.Err() == nil {
+		err = fmt.Errorf("script timed out after %s: %w", config.ScriptTimeout, ctx.Err())
+	}
+
+	d := output.Decision()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil && decides {
+		switch exitErr.ExitCode() {
+		case exitSkip:
+			d.Action, err = "skip", nil
+		case exitDefer:
+			d.Action, err = "defer", nil
+		}
+	}
+
+	if err != nil {
+		if tail := output.Tail(); tail != "" {
+			return decision{}, fmt.Errorf("error running script: %w\nLast output:\n%s", err, tail)
+		}
+		return decision{}, fmt.Errorf("error running script: %w", err)
+	}
+
+	return d, nil
+}
+
+// scriptOutputTail is the number of output lines kept for error messages.
+const scriptOutputTail = 20
+
+// maxScriptLine is the length after which a line without a newline is
+// printed anyway.
+const maxScriptLine = 64 * 1024
+
+// scriptOutput prints the output of a script line by line with a prefix,
+// or logs each line when log is set, and keeps its last lines.
+type scriptOutput struct {
+	mu      sync.Mutex
+	out     io.Writer
+	log     *slog.Logger
+	capture io.Writer
+	prefix  string
+	buf     []byte
+	tail    []string
+	// decision is set by the last "migrate:skip" or "migrate:defer" line.
+	decision decision
+}
+
+func (o *scriptOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.buf = append(o.buf, p...)
+	for {
+		i := bytes.IndexByte(o.buf, '\n')
+		if i < 0 {
+			break
+		}
+		o.line(string(o.buf[:i]))
+		o.buf = o.buf[i+1:]
+	}
+	if len(o.buf) >= maxScriptLine {
+		o.line(string(o.buf))
+		o.buf = nil
+	}
+	return len(p), nil
+}
+
+// Flush prints the last line when the script did not end it.
+func (o *scriptOutput) Flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.buf) > 0 {
+		o.line(string(o.buf))
+		o.buf = nil
+	}
+}
+
+// Decision returns the decision printed by the script, if any.
+func (o *scriptOutput) Decision() decision {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.decision
+}
+
+// Tail returns the last lines of the output.
+func (o *scriptOutput) Tail() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return strings.Join(o.tail, "\n")
+}
+
+func (o *scriptOutput) line(line string) {
+	line = strings.TrimSuffix(line, "\r")
+	for _, action := range []string{"skip", "defer"} {
+		marker := "migrate:" + action
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), marker); ok && (rest == "" || rest[0] == ' ') {
+			o.decision = decision{Action: action, Reason: strings.TrimSpace(rest)}
+		}
+	}
+	if o.log != nil {
+		o.log.Info("Script output", "line", line)
+	} else {
+		fmt.Fprintf(o.out, "[%s] %s\n", o.prefix, line)
+	}
+	if o.capture != nil {
+		fmt.Fprintf(o.capture, "[%s] %s\n", o.prefix, line)
+	}
+
+	o.tail = append(o.tail, line)
+	if len(o.tail) > scriptOutputTail {
+		o.tail = o.tail[1:]
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package handlers
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// killProcessGroup leaves cancellation to kill only the script itself, as
+// process groups are not available.
+func killProcessGroup(cmd *exec.Cmd) {}
+
+func limitResources(args []string, limits config.ScriptLimits) ([]string, error) {
+	return nil, fmt.Errorf("-script-limits is only supported on Unix")
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package handlers
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// killProcessGroup starts the script in its own process group and makes
+// cancellation kill the whole group, so processes started by the script
+// do not outlive it.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// limitResources wraps the command line of a script in a shell setting
+// the limits with ulimit, so they apply to the script alone.
+func limitResources(args []string, limits config.ScriptLimits) ([]string, error) {
+	var ulimits []string
+	if limits.CPU > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -t %d", int64(limits.CPU.Seconds())))
+	}
+	if limits.Memory > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -v %d", (limits.Memory+1023)/1024))
+	}
+	if limits.Files > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -n %d", limits.Files))
+	}
+
+	script := strings.Join(append(ulimits, `exec "$@"`), " && ")
+	return append([]string{"/bin/sh", "-c", script, "sh"}, args...), nil
+}
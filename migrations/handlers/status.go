@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+)
+
+// Migration states shown by the status command.
+const (
+	StateApplied  = "applied"
+	StatePending  = "pending"
+	StateMissing  = "missing"
+	StateModified = "modified"
+)
+
+// MigrationStatus is one row of the status command: a migration on disk,
+// in the history, or both.
+type MigrationStatus struct {
+	Version     string
+	State       string
+	AppliedAt   time.Time
+	Description string
+	Recorded    string
+	Note        string
+	// OutOfOrder is set for pending migrations older than the newest
+	// applied one.
+	OutOfOrder bool
+}
+
+func handleStatusCommand(ctx context.Context, db *sql.DB, config config.Config, report *Report) error {
+	statuses, err := LoadMigrationStatus(ctx, db, config)
+	if err != nil {
+		return err
+	}
+
+	current := ""
+	counts := make(map[string]int)
+	var older, deferred []string
+	for _, s := range statuses {
+		counts[s.State]++
+		if s.Recorded == RecordDeferred {
+			deferred = append(deferred, s.Version)
+		}
+		if s.State != StatePending {
+			current = s.Version
+		}
+		if s.OutOfOrder {
+			older = append(older, s.Version)
+		}
+	}
+
+	if version := config.Commands.Version; version != "" {
+		statuses = filterStatus(statuses, version)
+		if len(statuses) == 0 {
+			return fmt.Errorf("migration %s not found on disk or in history", version)
+		}
+	}
+
+	if current == "" {
+		current = "none"
+	}
+
+	for _, s := range statuses {
+		report.add(MigrationReport{
+			Version:     s.Version,
+			State:       s.State,
+			AppliedAt:   appliedAt(s.AppliedAt),
+			Description: s.Description,
+			Recorded:    s.Recorded,
+			Note:        s.Note,
+			OutOfOrder:  s.OutOfOrder,
+		})
+	}
+	report.Summary = counts
+	report.CurrentVersion = current
+	if config.Structured() {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(config.Out(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tSTATE\tAPPLIED AT\tDESCRIPTION")
+	for _, s := range statuses {
+		applied := "-"
+		if !s.AppliedAt.IsZero() {
+			applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Version, s.State, applied, s.Description)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(config.Out(), "Current version: %s (%d applied, %d pending, %d missing, %d modified)\n",
+		current, counts[StateApplied], counts[StatePending], counts[StateMissing], counts[StateModified])
+	if len(older) > 0 {
+		fmt.Fprintf(config.Out(), "Warning: %d pending migration(s) older than the current version: %s\n", len(older), strings.Join(older, ", "))
+	}
+	if len(deferred) > 0 {
+		fmt.Fprintf(config.Out(), "Deferred by their scripts: %s\n", strings.Join(deferred, ", "))
+	}
+
+	return nil
+}
+
+func filterStatus(statuses []MigrationStatus, version string) []MigrationStatus {
+	for _, s := range statuses {
+		if s.Version == version {
+			return []MigrationStatus{s}
+		}
+	}
+	return nil
+}
+
+// LoadMigrationStatus merges the migrations on disk with the history,
+// ordered by version. Applied migrations whose files changed since they
+// were applied are reported as modified, and history entries without files
+// as missing.
+func LoadMigrationStatus(ctx context.Context, db *sql.DB, config config.Config) ([]MigrationStatus, error) {
+	onDisk, err := listMigrations(config)
+	if err != nil {
+		return nil, err
+	}
+
+	historyMigrations, err := LoadHistoryMigrations(ctx, db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make(map[string]Migration)
+	for _, m := range historyMigrations {
+		history[m.Migration] = m
+	}
+
+	deferred, err := LoadDeferredMigrations(ctx, db, config)
+	if err != nil {
+		return nil, err
+	}
+	deferredNotes := make(map[string]string)
+	for _, m := range deferred {
+		deferredNotes[m.Migration] = m.Note
+	}
+
+	var statuses []MigrationStatus
+	for _, version := range onDisk {
+		status := MigrationStatus{Version: version, State: StatePending, Description: loadDescription(config, version)}
+		if note, ok := deferredNotes[version]; ok {
+			status.Recorded, status.Note = RecordDeferred, note
+		}
+		if m, ok := history[version]; ok {
+			status.State = StateApplied
+			status.AppliedAt = m.AppliedAt
+			status.Recorded, status.Note = m.Status, m.Note
+			if m.Checksum != "" {
+				checksum, err := MigrationChecksum(config, version)
+				if err != nil {
+					return nil, err
+				}
+				if checksum != m.Checksum {
+					status.State = StateModified
+				}
+			}
+			delete(history, version)
+		}
+		statuses = append(statuses, status)
+	}
+
+	for _, m := range history {
+		statuses = append(statuses, MigrationStatus{Version: m.Migration, State: StateMissing, AppliedAt: m.AppliedAt, Recorded: m.Status, Note: m.Note})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	var pending []string
+	for _, s := range statuses {
+		if s.State == StatePending {
+			pending = append(pending, s.Version)
+		}
+	}
+	older, _ := outOfOrder(historyMigrations, pending)
+	for i := range statuses {
+		statuses[i].OutOfOrder = older[statuses[i].Version] && statuses[i].Recorded != RecordDeferred
+	}
+
+	return statuses, nil
+}
+
+// MigrationChecksum hashes the files run when the migration is applied,
+// so later edits can be detected. It returns an empty string when the
+// migration has no such files.
+func MigrationChecksum(config config.Config, migration string) (string, error) {
+	entries, err := os.ReadDir(filepath.Join(config.Path, migration))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading migration %s: %v", migration, err)
+	}
+
+	hash := sha256.New()
+	found := false
+	for _, entry := range entries {
+		if entry.IsDir() || !isUpFile(entry.Name()) {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(config.Path, migration, entry.Name()))
+		if err != nil {
+			return "", fmt.Errorf("error reading file %s: %v", entry.Name(), err)
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", entry.Name(), len(content))
+		hash.Write(content)
+		found = true
+	}
+
+	if !found {
+		return "", nil
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// isUpFile reports whether the file is run when the migration is applied:
+// the up SQL, the up script or an up hook, or decides how: meta.yaml.
+func isUpFile(name string) bool {
+	if name == MetaFile {
+		return true
+	}
+	for _, prefix := range []string{"up.", PhasePreUp + ".", PhasePostUp + "."} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadDescription returns the description written by the create command,
+// stored as "## <description>" in a .txt file of the migration.
+func loadDescription(config config.Config, migration string) string {
+	matches, _ := filepath.Glob(filepath.Join(config.Path, migration, "*.txt"))
+	if len(matches) == 0 {
+		return ""
+	}
+
+	content, err := os.ReadFile(matches[0])
+	if err != nil {
+		return ""
+	}
+
+	line, _, _ := strings.Cut(string(content), "\n")
+	return strings.TrimSpace(strings.TrimPrefix(line, "##"))
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/config"
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/db"
+	"github.com/Karol7Krawczyk/golang-migrate/migrations/handlers"
+)
+
+type target struct {
+	Name   string
+	Config config.Config
+}
+
+type targetResult struct {
+	Target   target
+	Status   string
+	Duration time.Duration
+	Pending  int
+	Report   *handlers.Report
+	Err      error
+}
+
+// targetsReport is the summary of a run against many targets as printed by
+// -output json or yaml.
+type targetsReport struct {
+	Targets   []targetReport `json:"targets" yaml:"targets"`
+	Succeeded int            `json:"succeeded" yaml:"succeeded"`
+	Failed    int            `json:"failed" yaml:"failed"`
+}
+
+type targetReport struct {
+	Target     string           `json:"target" yaml:"target"`
+	Status     string           `json:"status" yaml:"status"`
+	Pending    int              `json:"pending" yaml:"pending"`
+	DurationMs int64            `json:"duration_ms" yaml:"duration_ms"`
+	Error      string           `json:"error,omitempty" yaml:"error,omitempty"`
+	Result     *handlers.Report `json:"result,omitempty" yaml:"result,omitempty"`
+}
+
+const (
+	targetOK      = "ok"
+	targetFailed  = "failed"
+	targetSkipped = "skipped"
+)
+
+// loadTargets returns the databases listed by -targets or -targets-query,
+// or the Postgres schemas matching -schemas. The registry database for
+// -targets-query and -schemas is the one configured by the regular
+// connection flags.
+func loadTargets(ctx context.Context, config config.Config) ([]target, error) {
+	if config.Schemas != "" {
+		return loadSchemaTargets(ctx, config)
+	}
+
+	var dsns []string
+	var err error
+
+	switch {
+	case config.Targets != "":
+		dsns, err = readTargetsFile(config.Targets)
+	case config.TargetsQuery != "":
+		dsns, err = queryTargets(ctx, config, config.TargetsQuery)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]target, 0, len(dsns))
+	for _, dsn := range dsns {
+		targetConfig := config
+		targetConfig.DSN = dsn
+		targets = append(targets, target{Name: targetConfig.RedactedDSN(), Config: targetConfig})
+	}
+
+	return targets, nil
+}
+
+// readTargetsFile reads one connection string per line, skipping blank
+// lines and lines starting with #.
+func readTargetsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening targets file: %v", err)
+	}
+	defer file.Close()
+
+	var dsns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dsns = append(dsns, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading targets file: %v", err)
+	}
+
+	return dsns, nil
+}
+
+// loadSchemaTargets returns one target per schema matching config.Schemas,
+// each with its own migration table inside the schema.
+func loadSchemaTargets(ctx context.Context, config config.Config) ([]target, error) {
+	if config.DBType != "postgres" {
+		return nil, fmt.Errorf("-schemas is only supported for postgres, not %s", config.DBType)
+	}
+
+	schemas, err := queryTargets(ctx, config,
+		"SELECT schema_name FROM information_schema.schemata WHERE schema_name LIKE $1 ORDER BY schema_name", config.Schemas)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]target, 0, len(schemas))
+	for _, schema := range schemas {
+		targetConfig := config
+		targetConfig.Schema = schema
+		targets = append(targets, target{Name: schema, Config: targetConfig})
+	}
+
+	return targets, nil
+}
+
+// queryTargets runs query against the registry database and returns the
+// first column of every row.
+func queryTargets(ctx context.Context, config config.Config, query string, args ...interface{}) ([]string, error) {
+	registry, err := db.GetConnection(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the registry database: %v", err)
+	}
+	defer db.CloseConnection(registry)
+
+	rows, err := registry.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying targets: %v", err)
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value sql.NullString
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("error scanning target row: %v", err)
+		}
+		if value.Valid && strings.TrimSpace(value.String) != "" {
+			values = append(values, strings.TrimSpace(value.String))
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over target rows: %v", err)
+	}
+
+	return values, nil
+}
+
+// runTargets runs the command against every target, at most
+// config.Concurrency at a time. A failing target does not stop the others
+// unless config.FailFast is set, in which case targets not yet started are
+// skipped and running ones are cancelled.
+func runTargets(parent context.Context, targets []target, config config.Config) []targetResult {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	messages := io.Writer(os.Stdout)
+	if config.Structured() {
+		messages = os.Stderr
+	}
+
+	results := make([]targetResult, len(targets))
+	semaphore := make(chan struct{}, concurrency)
+	var mu sync.Mutex
+	logger := config.NewLogger(&lockedWriter{w: messages, mu: &mu})
+	var wg sync.WaitGroup
+
+	for i, t := range targets {
+		semaphore <- struct{}{}
+		if ctx.Err() != nil {
+			<-semaphore
+			err := parent.Err()
+			if err == nil {
+				err = errors.New("not started after an earlier failure")
+			}
+			results[i] = targetResult{Target: t, Status: targetSkipped, Err: err}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			out := &prefixWriter{prefix: "[" + t.Name + "] ", w: messages, mu: &mu}
+			t.Config.Output = out
+			t.Config.Log = logger.With("target", t.Name)
+
+			start := time.Now()
+			report, pending, err := runTarget(ctx, t.Config)
+			out.Flush()
+
+			results[i] = targetResult{Target: t, Status: targetOK, Duration: time.Since(start), Pending: pending, Report: report}
+			if err != nil {
+				results[i].Status = targetFailed
+				results[i].Err = err
+				if config.FailFast {
+					cancel()
+				}
+			}
+		}(i, t)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// runTarget runs the command against one target and returns its report
+// and how many migrations are still pending there afterwards.
+func runTarget(ctx context.Context, config config.Config) (*handlers.Report, int, error) {
+	report, err := runCommand(ctx, config)
+	if err != nil {
+		return report, 0, err
+	}
+
+	database, err := db.GetConnection(ctx, config)
+	if err != nil {
+		return report, 0, fmt.Errorf("error connecting to the database: %v", err)
+	}
+	defer db.CloseConnection(database)
+
+	pending, err := handlers.PendingMigrations(ctx, database, config)
+	if err != nil {
+		return report, 0, err
+	}
+
+	return report, len(pending), nil
+}
+
+func printTargetSummary(w io.Writer, results []targetResult) (failed int) {
+	var behind []string
+
+	fmt.Fprintln(w, "Summary:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTATUS\tPENDING\tDURATION\tERROR")
+	for _, r := range results {
+		errText, pending := "", "-"
+		if r.Err != nil {
+			errText = r.Err.Error()
+		}
+		if r.Status != targetOK {
+			failed++
+		} else {
+			pending = fmt.Sprint(r.Pending)
+			if r.Pending > 0 {
+				behind = append(behind, fmt.Sprintf("%s (%d)", r.Target.Name, r.Pending))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Target.Name, r.Status, pending, r.Duration.Round(time.Millisecond), errText)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "%d of %d targets succeeded\n", len(results)-failed, len(results))
+	if len(behind) > 0 {
+		fmt.Fprintf(w, "%d targets behind: %s\n", len(behind), strings.Join(behind, ", "))
+	}
+	return failed
+}
+
+func writeTargetsReport(w io.Writer, format string, results []targetResult) (failed int, err error) {
+	report := targetsReport{Targets: make([]targetReport, 0, len(results))}
+	for _, r := range results {
+		t := targetReport{
+			Target:     r.Target.Name,
+			Status:     r.Status,
+			Pending:    r.Pending,
+			DurationMs: r.Duration.Milliseconds(),
+			Result:     r.Report,
+		}
+		if r.Err != nil {
+			t.Error = r.Err.Error()
+		}
+		if r.Status == targetOK {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+		report.Targets = append(report.Targets, t)
+	}
+
+	return report.Failed, handlers.WriteReport(w, format, report)
+}
+
+func runFanOut(ctx context.Context, config config.Config) int {
+	targets, err := loadTargets(ctx, config)
+	if err != nil {
+		slog.Error("Error loading targets", "error", err)
+		return exitCode(ctx)
+	}
+
+	if len(targets) == 0 {
+		slog.Error("No targets to migrate")
+		return exitError
+	}
+
+	if handlers.Confirms(config) && !config.Commands.Yes && config.Commands.Confirm == "" {
+		slog.Error("The command asks for confirmation, which is not possible for several targets; use -yes", "command", config.Command)
+		return exitError
+	}
+	if handlers.Confirms(config) && handlers.Protected(config) && config.Protection == "confirm" {
+		// Without -env every target would be confirmed by its own schema or
+		// database name, which no single -confirm can match.
+		if config.Env == "" {
+			slog.Error("A protected run against several targets is confirmed by the environment name; select one with -env", "command", config.Command)
+			return exitError
+		}
+		if config.Commands.Confirm == "" {
+			slog.Error("The environment is protected and its name cannot be typed for several targets; use -confirm", "command", config.Command)
+			return exitError
+		}
+	}
+
+	results := runTargets(ctx, targets, config)
+	if config.Structured() {
+		failed, err := writeTargetsReport(os.Stdout, config.Format, results)
+		if err != nil {
+			slog.Error("Error writing the result", "error", err)
+			return exitError
+		}
+		if failed > 0 {
+			return exitCode(ctx)
+		}
+		return 0
+	}
+
+	if printTargetSummary(os.Stdout, results) > 0 {
+		return exitCode(ctx)
+	}
+
+	return 0
+}
+
+// prefixWriter writes complete lines prefixed with the target name, so the
+// output of targets running at the same time does not interleave mid-line.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	mu     *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf.Write(b)
+	for {
+		i := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		line := p.buf.Next(i + 1)
+		p.mu.Lock()
+		_, err := fmt.Fprintf(p.w, "%s%s", p.prefix, line)
+		p.mu.Unlock()
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// Flush writes a trailing line that has no newline yet.
+func (p *prefixWriter) Flush() {
+	if p.buf.Len() > 0 {
+		p.Write([]byte("\n"))
+	}
+}
+
+// lockedWriter writes to w holding mu, shared with the prefixWriters of
+// the targets.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}